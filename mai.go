@@ -1,97 +1,435 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"testmdns/pkg"
+
+	"github.com/miekg/dns"
 )
 
 func main() {
+	profiles := flag.String("profile", "googlecast",
+		"perfiles de servicio del dispositivo, separados por comas ("+strings.Join(pkg.ProfileNames(), ", ")+")")
+	services := flag.String("services", "",
+		"tipos de servicio (separados por comas) que se preguntan al dispositivo; por defecto los del perfil")
+	apiAddr := flag.String("api", "", "dirección HTTP de la API (inventario...); vacío la desactiva")
+	spoof := flag.String("spoof", pkg.SpoofAction, "qué hacer si otro equipo anuncia los registros del dispositivo: flag|drop")
+	toClient := flag.String("to-client", "records=device->proxy",
+		"reescritura de lo que va de dispositivos a clientes (questions=...,records=...)")
+	toDevice := flag.String("to-device", "questions=proxy->device",
+		"reescritura de lo que va de clientes a dispositivos")
+	var remaps []string
+	flag.Func("port-map", "anunciar y escuchar un puerto del dispositivo en otro: DISPOSITIVO=ANUNCIADO, p. ej. 8009=8010 (se puede repetir)", func(s string) error {
+		if _, _, err := pkg.ParsePortRemap(s); err != nil {
+			return err
+		}
+		remaps = append(remaps, s)
+		return nil
+	})
+	local := flag.String("local", "", "reescritura de lo que genera el propio proxy")
+	var clients []string
+	flag.Func("client", "política por cliente SUBRED=IPPROXY (se puede repetir)", func(s string) error {
+		clients = append(clients, s)
+		return nil
+	})
+	var virtuals []string
+	flag.Func("virtual", "dispositivo virtual IP,NOMBRE[,ID] (se puede repetir; sin ID se deriva uno del original y del nombre)", func(s string) error {
+		virtuals = append(virtuals, s)
+		return nil
+	})
+	aliases := flag.Bool("aliases", false, "añadir las IPs de proxy a la interfaz de clientes al arrancar y quitarlas al salir")
+	respond := flag.Bool("respond", false, "contestar en la interfaz de clientes las preguntas A/AAAA por el nombre de host del dispositivo")
+	flag.Func("hostname", "nombre de host del dispositivo para -respond (se puede repetir)", func(s string) error {
+		pkg.AddHostname(s)
+		return nil
+	})
+	flag.Func("forward", "reenvío TCP ESCUCHA=DESTINO[,upstream=DESTINO][,balance=roundrobin][,check=tls][,timeout=5s][,log=false][,proxy-in=SUBRED][,proxy-out=1|2][,keep-ip=true][,acl=REGLA] (se puede repetir; sustituye a los puertos del perfil)", func(s string) error {
+		pm, err := pkg.ParsePortMapping(s)
+		if err != nil {
+			return err
+		}
+		pkg.PortMap = append(pkg.PortMap, pm)
+		return nil
+	})
+	flag.Func("proxy-in", "balanceador de confianza (IP o SUBRED) que envía la cabecera PROXY (v1/v2) a los puertos del perfil y de los SRV; se rechaza a los demás (se puede repetir)", func(s string) error {
+		n, err := pkg.ParseTrustedProxy(s)
+		if err != nil {
+			return err
+		}
+		pkg.ProxyProtoIn = append(pkg.ProxyProtoIn, n)
+		return nil
+	})
+	flag.IntVar(&pkg.ProxyProtoOut, "proxy-out", 0, "enviar al dispositivo la cabecera PROXY de esta versión (1 o 2); 0 no la envía")
+	flag.StringVar(&pkg.Transparent, "transparent", "", "proxy transparente con iptables: redirect|tproxy (vacío lo desactiva)")
+	flag.StringVar(&pkg.TransparentListen, "transparent-listen", pkg.TransparentListen, "dirección de escucha del proxy transparente")
+	flag.BoolVar(&pkg.KeepClientIP, "keep-ip", false, "conectar con el dispositivo desde la IP del cliente (IP_TRANSPARENT; el dispositivo debe encaminar las respuestas por el proxy)")
+	flag.Func("replica", "otra IP que sirve lo mismo que el dispositivo (se puede repetir)", func(s string) error {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("IP no válida %q", s)
+		}
+		pkg.DeviceReplicas = append(pkg.DeviceReplicas, ip)
+		return nil
+	})
+	flag.StringVar(&pkg.DeviceBalance, "balance", pkg.DeviceBalance, "reparto entre el dispositivo y sus réplicas: failover|roundrobin")
+	flag.StringVar(&pkg.DeviceCheck, "check", pkg.DeviceCheck, "comprobación de salud de los destinos: tcp|tls|none")
+	flag.DurationVar(&pkg.HealthInterval, "check-interval", pkg.HealthInterval, "cada cuánto se comprueban los destinos")
+	flag.IntVar(&pkg.MaxConns, "max-conns", 0, "máximo de conexiones TCP abiertas a la vez; 0 sin límite")
+	flag.IntVar(&pkg.MaxConnsPerIP, "max-conns-per-ip", 0, "máximo de conexiones TCP abiertas a la vez por IP de origen; 0 sin límite")
+	flag.Float64Var(&pkg.AcceptRate, "accept-rate", 0, "máximo de conexiones TCP nuevas por segundo; 0 sin límite")
+	flag.IntVar(&pkg.AcceptBurst, "accept-burst", pkg.AcceptBurst, "ráfaga de conexiones permitida por encima de -accept-rate")
+	flag.DurationVar(&pkg.IdleTimeout, "idle-timeout", 0, "cortar las sesiones TCP sin tráfico durante este tiempo; 0 nunca")
+	flag.DurationVar(&pkg.MaxSessionTime, "max-session", 0, "duración máxima de una sesión TCP; 0 sin límite")
+	flag.BoolVar(&pkg.KeepAlive.Enable, "keepalive", pkg.KeepAlive.Enable, "keepalive TCP con el cliente y con el destino")
+	flag.DurationVar(&pkg.KeepAlive.Idle, "keepalive-idle", pkg.KeepAlive.Idle, "inactividad antes del primer keepalive")
+	flag.DurationVar(&pkg.KeepAlive.Interval, "keepalive-interval", pkg.KeepAlive.Interval, "intervalo entre keepalives")
+	flag.IntVar(&pkg.KeepAlive.Count, "keepalive-count", pkg.KeepAlive.Count, "keepalives sin respuesta antes de cortar")
+	flag.Func("acl", "regla de acceso [PUERTO/]allow|deny:SUBRED|iface=NOMBRE|mac=MAC|all (se puede repetir; sin puerto vale para todos)", func(s string) error {
+		port, r, err := pkg.ParsePortACLRule(s)
+		if err != nil {
+			return err
+		}
+		pkg.ACLs[port] = append(pkg.ACLs[port], r)
+		return nil
+	})
+	flag.Func("udp", "puerto o rango UDP (5000 o 32768-32800) que se reenvía al dispositivo además de los del perfil (se puede repetir)", func(s string) error {
+		ports, err := pkg.ParseUDPPorts(s)
+		if err != nil {
+			return err
+		}
+		pkg.UDPPorts = append(pkg.UDPPorts, ports...)
+		return nil
+	})
+	flag.IntVar(&pkg.UDPMaxSessions, "udp-max-sessions", pkg.UDPMaxSessions, "máximo de sesiones UDP a la vez por puerto; 0 sin límite")
+	flag.DurationVar(&pkg.UDPIdle, "udp-idle", pkg.UDPIdle, "tiempo sin tráfico tras el que se cierra una sesión UDP")
+	flag.DurationVar(&pkg.DrainTimeout, "drain", pkg.DrainTimeout, "al apagar, tiempo máximo de espera a que terminen las sesiones TCP")
+	flag.Parse()
+	args := flag.Args()
 
-	if len(os.Args) < 5 {
-		log.Fatalf("Uso: %s <interface client> <interface devices> <ipDevice> <ipProxy>", os.Args[0])
+	if len(args) < 3 {
+		log.Fatalf("Uso: %s [opciones] <interface client> <interface devices> <ipDevice|nombre> [ipProxy]", os.Args[0])
+	}
+	if err := pkg.UseProfiles(strings.Split(*profiles, ",")); err != nil {
+		log.Fatalf("Perfil no válido: %s", err)
+	}
+	for _, s := range remaps {
+		from, to, _ := pkg.ParsePortRemap(s)
+		pkg.ActiveProfile.Ports[from] = to
+	}
+	pkg.DeviceServices = pkg.ActiveProfile.Services
+	if *services != "" {
+		pkg.DeviceServices = splitServices(*services)
 	}
 
-	go pkg.Redirect()
+	if *spoof != pkg.SpoofFlag && *spoof != pkg.SpoofDrop {
+		log.Fatalf("Valor de -spoof no válido: %s", *spoof)
+	}
+	pkg.SpoofAction = *spoof
+	if pkg.DeviceBalance != pkg.BalanceFailover && pkg.DeviceBalance != pkg.BalanceRoundRobin {
+		log.Fatalf("Valor de -balance no válido: %s", pkg.DeviceBalance)
+	}
+	if pkg.DeviceCheck != pkg.CheckTCP && pkg.DeviceCheck != pkg.CheckTLS && pkg.DeviceCheck != pkg.CheckNone {
+		log.Fatalf("Valor de -check no válido: %s", pkg.DeviceCheck)
+	}
+	if err := pkg.CheckProxyACLs(); err != nil {
+		log.Fatalf("ACL no válida: %s", err)
+	}
+	if pkg.Transparent != "" && pkg.Transparent != pkg.TransparentRedirect && pkg.Transparent != pkg.TransparentTProxy {
+		log.Fatalf("Valor de -transparent no válido: %s", pkg.Transparent)
+	}
+	if pkg.ProxyProtoOut < 0 || pkg.ProxyProtoOut > 2 {
+		log.Fatalf("Valor de -proxy-out no válido: %d", pkg.ProxyProtoOut)
+	}
+	pkg.Respond = *respond
 
-	addr := "224.0.0.251:5353"
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
-	if err != nil {
-		log.Fatalf("Fallo al resolver la dirección UDP: %s", err)
+	for dir, s := range map[pkg.Direction]string{pkg.ToClient: *toClient, pkg.ToDevice: *toDevice, pkg.Local: *local} {
+		p, err := pkg.ParsePolicy(s)
+		if err != nil {
+			log.Fatalf("Política de %s no válida: %s", dir, err)
+		}
+		pkg.Policies[dir] = p
+	}
+
+	for _, c := range clients {
+		p, err := pkg.ParseClientPolicy(c)
+		if err != nil {
+			log.Fatalf("Política de cliente no válida: %s", err)
+		}
+		pkg.ClientPolicies = append(pkg.ClientPolicies, p)
 	}
-	iface1Name := os.Args[1]
-	iface2Name := os.Args[2]
-	pkg.IpDevice = net.ParseIP(os.Args[3])
-	pkg.IpProxy = net.ParseIP(os.Args[4])
 
-	pkg.PtrDevice = pkg.IpToPtr(pkg.IpDevice)
-	pkg.PtrProxy = pkg.IpToPtr(pkg.IpProxy)
+	for _, s := range virtuals {
+		v, err := pkg.ParseVirtualDevice(s)
+		if err != nil {
+			log.Fatalf("Dispositivo virtual no válido: %s", err)
+		}
+		pkg.VirtualDevices = append(pkg.VirtualDevices, v)
+	}
 
-	if pkg.IpDevice == nil || pkg.IpProxy == nil {
-		log.Fatalf("Fallo al analizar las direcciones IP: %s", err)
+	if *apiAddr != "" {
+		go func() {
+			log.Printf("Error en la API: %v", pkg.ServeAPI(*apiAddr))
+		}()
 	}
 
-	iface1, err := net.InterfaceByName(iface1Name)
-	if err != nil {
-		log.Fatalf("Fallo al obtener la interfaz de red: %s", err)
+	// Al recibir SIGINT/SIGTERM se deja de aceptar y se drenan las sesiones.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	redirectDone := make(chan struct{})
+	go func() {
+		if err := pkg.Redirect(ctx); err != nil {
+			log.Fatalf("Error en el proxy TCP: %v", err)
+		}
+		close(redirectDone)
+	}()
+	go pkg.RelayUDP(ctx)
+
+	iface1Name := args[0]
+	iface2Name := args[1]
+	pkg.DeviceIface = iface2Name
+	// Si no es una IP, es el nombre mDNS del dispositivo y se resuelve más
+	// abajo, cuando la interfaz de dispositivos esté abierta.
+	ipDevice := net.ParseIP(args[2])
+	if ipDevice != nil {
+		pkg.SetDevice(ipDevice)
 	}
 
-	iface2, err := net.InterfaceByName(iface2Name)
-	if err != nil {
-		log.Fatalf("Fallo al obtener la interfaz de red: %s", err)
+	// Sin ipProxy usamos la dirección de la interfaz de clientes y la
+	// seguimos si cambia (DHCP).
+	autoProxy := len(args) < 4
+	if autoProxy {
+		if err := pkg.AutoProxy(iface1Name); err != nil {
+			log.Fatalf("Fallo al obtener la IP del proxy de %s: %s", iface1Name, err)
+		}
+	} else {
+		ipProxy := net.ParseIP(args[3])
+		if ipProxy == nil {
+			log.Fatalf("Fallo al analizar la dirección IP del proxy: %s", args[3])
+		}
+		pkg.SetProxy(ipProxy, nil)
+	}
+
+	// IPs de proxy como direcciones secundarias de la interfaz de clientes.
+	var al *pkg.Aliases
+	if *aliases {
+		var ips []net.IP
+		if !autoProxy {
+			ips = append(ips, pkg.IpProxy)
+		}
+		for _, p := range pkg.ClientPolicies {
+			ips = append(ips, p.Proxy)
+		}
+		for _, v := range pkg.VirtualDevices {
+			ips = append(ips, v.Proxy)
+		}
+		var err error
+		al, err = pkg.AddAliases(iface1Name, ips)
+		if err != nil {
+			log.Fatalf("Fallo al añadir las IPs de proxy: %s", err)
+		}
+	}
+
+	// Reglas de iptables y rutas del proxy transparente y de keep-ip.
+	keepIP := pkg.KeepClientIP
+	for _, pm := range pkg.PortMap {
+		keepIP = keepIP || pm.KeepIP
+	}
+	var undoRouting func()
+	if pkg.Transparent != "" || keepIP {
+		var err error
+		undoRouting, err = setupRouting(iface1Name, iface2Name, keepIP)
+		if err != nil {
+			if al != nil {
+				al.Remove()
+			}
+			log.Fatalf("Fallo al preparar las reglas de encaminamiento: %s", err)
+		}
 	}
 
 	// mgr, _ := pkg.New()
 	// _ = mgr.AddRedirect(pkg.IpDevice.String(), pkg.IpProxy.String()) // añade DNAT (excepto 5353)
 	// _ = mgr.AddMasquerade(iface2Name)
 
-	conn1, err := net.ListenMulticastUDP("udp4", iface1, udpAddr)
-	if err != nil {
-		log.Fatalf("Fallo al iniciar el listener UDP: %s", err)
+	conn1 := pkg.NewMcastIface(iface1Name)
+	if err := conn1.Open(); err != nil {
+		log.Fatalf("Fallo al iniciar el listener UDP en %s: %s", iface1Name, err)
 	}
 	defer conn1.Close()
 
-	conn2, err := net.ListenMulticastUDP("udp4", iface2, udpAddr)
-	if err != nil {
-		log.Fatalf("Fallo al iniciar el listener UDP: %s", err)
+	conn2 := pkg.NewMcastIface(iface2Name)
+	if err := conn2.Open(); err != nil {
+		log.Fatalf("Fallo al iniciar el listener UDP en %s: %s", iface2Name, err)
 	}
 	defer conn2.Close()
 
+	// Consultas periódicas y refrescos para tener al día la caché del dispositivo.
+	querier := pkg.NewQuerier(iface2Name, func(b []byte) error {
+		return conn2.WriteTo(b, pkg.MdnsGroup)
+	})
+	if ipDevice == nil {
+		pkg.DeviceByName(args[2])
+	}
+	go querier.Run()
+
+	// Si una interfaz se cae o cambia de dirección, los sockets se reabren solos.
 	go func() {
-		for {
-			// Leemos el paquete UDP entrante.
-			buf := make([]byte, 4000) // Tamaño estándar para DNS sobre UDP.
-			n, _, err := conn2.ReadFrom(buf)
-			//	fmt.Printf("Paquete recibido de %s\n", remoteAddr.String())
-			if err != nil {
-				log.Printf("Error al leer del socket UDP: %v", err)
-				continue
+		err := pkg.WatchNetlink(
+			func(ev pkg.LinkEvent) {
+				conn1.HandleLink(ev)
+				conn2.HandleLink(ev)
+				if ev.Name == iface2Name && ev.Up {
+					querier.Restart()
+				}
+			},
+			func(ev pkg.AddrEvent) {
+				conn1.HandleAddr(ev)
+				conn2.HandleAddr(ev)
+				if autoProxy {
+					pkg.HandleAddrProxy(ev)
+				}
+			},
+		)
+		log.Printf("Error en el monitor de netlink: %v", err)
+	}()
+
+	ifaces := map[string]*pkg.McastIface{iface1Name: conn1, iface2Name: conn2}
+	// Lo que entra por una interfaz sale por la otra: lo de los
+	// dispositivos hacia los clientes y al revés.
+	send := func(dst *pkg.McastIface, pkts []pkg.Packet) {
+		for _, p := range pkts {
+			out := dst
+			if p.Iface != "" {
+				out = ifaces[p.Iface]
+			}
+			to := p.To
+			if to == nil {
+				//write to 224.0.0.251:5353
+				to = pkg.MdnsGroup
+			}
+			if err := out.WriteTo(p.Data, to); err != nil {
+				log.Printf("Error al enviar por %s: %v", out.Name, err)
 			}
+		}
+	}
 
-			//write to 224.0.0.251:5353
-			conn2.WriteTo(pkg.Mdns(buf[:n]), &net.UDPAddr{
-				IP:   net.ParseIP("224.0.0.251"),
-				Port: 5353,
-			})
+	// Despedidas y anuncios de los servicios según la salud de sus destinos.
+	pkg.AnnounceWith(func(pkts []pkg.Packet) {
+		send(conn1, pkts)
+	})
+
+	go conn2.Serve(func(b []byte, src *net.UDPAddr) {
+		send(conn1, pkg.Mdns(b, src, iface2Name, pkg.ToClient))
+	})
+
+	go conn1.Serve(func(b []byte, src *net.UDPAddr) {
+		send(conn2, pkg.Mdns(b, src, iface1Name, pkg.ToDevice))
+	})
+
+	<-ctx.Done()
+	log.Println("Apagando...")
+	<-redirectDone
+	if undoRouting != nil {
+		undoRouting()
+	}
+	if al != nil {
+		al.Remove()
+	}
+}
+
+// setupRouting prepara las reglas de iptables y las rutas del proxy
+// transparente (desviar los puertos TCP del perfil que entran por
+// clientIface) y de keepIP (recoger las respuestas que llegan por
+// deviceIface). Devuelve con qué deshacerlo.
+func setupRouting(clientIface, deviceIface string, keepIP bool) (func(), error) {
+	mgr, err := pkg.New()
+	if err != nil {
+		return nil, err
+	}
+
+	var undos []func()
+	undo := func() {
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i]()
 		}
-	}()
+	}
 
-	for {
-		// Leemos el paquete UDP entrante.
-		buf := make([]byte, 4000) // Tamaño estándar para DNS sobre UDP.
-		n, _, err := conn1.ReadFrom(buf)
-		//fmt.Printf("Paquete recibido de %s\n", remoteAddr.String())
+	if pkg.Transparent == pkg.TransparentTProxy || keepIP {
+		routing, err := pkg.AddLocalRouting()
 		if err != nil {
-			log.Printf("Error al leer del socket UDP: %v", err)
-			continue
+			return nil, err
 		}
+		undos = append(undos, routing.Remove)
+	}
 
-		//write to 224.0.0.251:5353
-		conn1.WriteTo(pkg.Mdns(buf[:n]), &net.UDPAddr{
-			IP:   net.ParseIP("224.0.0.251"),
-			Port: 5353,
+	if keepIP {
+		if err := mgr.AddSourceMark(deviceIface); err != nil {
+			undo()
+			return nil, fmt.Errorf("regla de las respuestas: %w", err)
+		}
+		undos = append(undos, func() {
+			if err := mgr.DelSourceMark(deviceIface); err != nil {
+				log.Printf("No se pudo quitar la regla de las respuestas: %v", err)
+			}
 		})
+		log.Printf("Recogiendo por %s las respuestas a conexiones con la IP del cliente", deviceIface)
+	}
 
+	if pkg.Transparent != "" {
+		_, p, err := net.SplitHostPort(pkg.TransparentListen)
+		if err != nil {
+			undo()
+			return nil, err
+		}
+		toPort, err := strconv.Atoi(p)
+		if err != nil {
+			undo()
+			return nil, err
+		}
+		ports := append([]int(nil), pkg.ActiveProfile.TCP...)
+		if len(ports) == 0 {
+			ports = []int{8009}
+		}
+		// Los clientes se conectan a los puertos anunciados (-port-map).
+		for _, port := range ports {
+			if to, ok := pkg.ActiveProfile.Ports[uint16(port)]; ok {
+				ports = append(ports, int(to))
+			}
+		}
+		for _, port := range ports {
+			if err := mgr.AddTransparent(pkg.Transparent, clientIface, port, toPort); err != nil {
+				undo()
+				return nil, fmt.Errorf("regla del puerto %d: %w", port, err)
+			}
+			undos = append(undos, func() {
+				if err := mgr.DelTransparent(pkg.Transparent, clientIface, port, toPort); err != nil {
+					log.Printf("No se pudo quitar la regla del puerto %d: %v", port, err)
+				}
+			})
+			log.Printf("Desviando %s:%d al proxy transparente (%s)", clientIface, port, pkg.Transparent)
+		}
+	}
+	return undo, nil
+}
+
+// splitServices separa la lista de servicios y les añade el punto final.
+func splitServices(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		out = append(out, dns.Fqdn(v))
 	}
+	return out
 }
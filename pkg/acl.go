@@ -0,0 +1,441 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sys/unix"
+)
+
+// ACLRule es una regla de acceso: permite o deniega a los clientes de una
+// subred, de una interfaz o con una MAC (de la tabla de vecinos del kernel).
+type ACLRule struct {
+	Allow bool
+	Net   *net.IPNet       // subred del cliente
+	Iface string           // interfaz por la que se ve al cliente
+	MAC   net.HardwareAddr // MAC del cliente
+	text  string
+}
+
+// ACLs son las reglas de cada puerto (TCP y UDP); las de la clave 0 valen
+// para todos. Las reglas se evalúan en orden y gana la primera que encaje;
+// si ninguna encaja se deniega si hay alguna allow y se permite si no.
+var ACLs = map[int][]ACLRule{}
+
+// ParseACLRule lee "allow:192.168.1.0/24", "deny:iface=eth1",
+// "allow:mac=aa:bb:cc:dd:ee:ff" o "deny:all".
+func ParseACLRule(s string) (ACLRule, error) {
+	action, filter, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return ACLRule{}, fmt.Errorf("falta ':' en %q", s)
+	}
+	r := ACLRule{text: s}
+	switch action {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return ACLRule{}, fmt.Errorf("acción no válida %q (allow|deny)", action)
+	}
+
+	switch k, v, _ := strings.Cut(filter, "="); k {
+	case "all":
+	case "iface":
+		r.Iface = v
+	case "mac":
+		mac, err := net.ParseMAC(v)
+		if err != nil {
+			return ACLRule{}, err
+		}
+		r.MAC = mac
+	default:
+		n, err := parseNet(filter)
+		if err != nil {
+			return ACLRule{}, fmt.Errorf("filtro no válido %q", filter)
+		}
+		r.Net = n
+	}
+	return r, nil
+}
+
+// parseNet lee una subred en notación CIDR o una IP suelta (/32 o /128).
+func parseNet(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil {
+			s = ip.String() + "/32"
+			if ip.To4() == nil {
+				s = ip.String() + "/128"
+			}
+		}
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+// ParsePortACLRule lee una regla de ParseACLRule con el puerto delante
+// ("8009/allow:10.0.0.0/8"); sin puerto vale para todos (0).
+func ParsePortACLRule(s string) (int, ACLRule, error) {
+	port := 0
+	if p, rest, ok := strings.Cut(s, "/"); ok && p != "" && strings.Trim(p, "0123456789") == "" {
+		n, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return 0, ACLRule{}, fmt.Errorf("puerto no válido %q", p)
+		}
+		port, s = int(n), rest
+	}
+	r, err := ParseACLRule(s)
+	return port, r, err
+}
+
+func (r ACLRule) String() string { return r.text }
+
+// CheckProxyACLs comprueba que las reglas de ACLs se puedan aplicar en los
+// puertos que esperan la cabecera PROXY (ProxyProtoIn o proxy-in= en el
+// mapa de puertos).
+func CheckProxyACLs() error {
+	if len(ProxyProtoIn) > 0 {
+		for _, rules := range ACLs {
+			if err := checkProxyACL(rules); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pm := range PortMap {
+		if len(pm.ProxyIn) == 0 {
+			continue
+		}
+		_, port, _ := net.SplitHostPort(pm.Listen)
+		n, _ := strconv.Atoi(port)
+		if err := checkProxyACL(portACL(n)); err != nil {
+			return fmt.Errorf("%s: %w", pm.Listen, err)
+		}
+	}
+	return nil
+}
+
+// checkProxyACL comprueba que rules se puedan aplicar detrás de un
+// balanceador: de la cabecera PROXY sólo sale la IP del cliente, y su MAC o
+// su interfaz son las del balanceador.
+func checkProxyACL(rules []ACLRule) error {
+	for _, r := range rules {
+		if r.Iface != "" || r.MAC != nil {
+			return fmt.Errorf("la regla %q no se puede aplicar con proxy-in (sólo subredes)", r)
+		}
+	}
+	return nil
+}
+
+// aclForPort devuelve las reglas de ip:port: las del listener que lo
+// atiende (mapa de puertos incluido) o, si no hay, las de ACLs.
+func aclForPort(ip net.IP, port int) []ACLRule {
+	listeners.Lock()
+	defer listeners.Unlock()
+	if l := findListener(ip, port); l != nil {
+		return l.acl
+	}
+	return portACL(port)
+}
+
+// haveACLs indica si hay alguna regla, global o de algún listener.
+func haveACLs() bool {
+	if len(ACLs) > 0 {
+		return true
+	}
+	listeners.Lock()
+	defer listeners.Unlock()
+	for _, l := range listeners.m {
+		if len(l.acl) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// portACL son las reglas de ACLs para port, las propias primero.
+func portACL(port int) []ACLRule {
+	rules := append([]ACLRule(nil), ACLs[port]...)
+	if port != 0 {
+		rules = append(rules, ACLs[0]...)
+	}
+	return rules
+}
+
+// allowed evalúa rules para el cliente ip. Si lo deniega, devuelve el
+// motivo.
+func allowed(rules []ACLRule, ip net.IP) (bool, string) {
+	if len(rules) == 0 {
+		return true, ""
+	}
+	var nb *neighbor
+	lookup := func() *neighbor {
+		if nb == nil {
+			nb = lookupNeighbor(ip)
+		}
+		return nb
+	}
+
+	for _, r := range rules {
+		var match bool
+		switch {
+		case r.Net != nil:
+			match = r.Net.Contains(ip)
+		case r.Iface != "":
+			match = lookup().iface == r.Iface
+		case r.MAC != nil:
+			match = bytes.Equal(lookup().mac, r.MAC)
+		default:
+			match = true
+		}
+		if !match {
+			continue
+		}
+		if r.Allow {
+			return true, ""
+		}
+		return false, "denegada por " + r.String()
+	}
+	for _, r := range rules {
+		if r.Allow {
+			return false, "no la permite ninguna regla"
+		}
+	}
+	return true, ""
+}
+
+// neighbor es lo que sabe el kernel de un cliente de un segmento vecino.
+type neighbor struct {
+	mac   net.HardwareAddr
+	iface string
+}
+
+// Lo que se sabe de cada vecino se guarda neighborTTL, para no volcar la
+// tabla del kernel en cada conexión; como mucho maxNeighbors.
+const (
+	neighborTTL  = 5 * time.Second
+	maxNeighbors = 1024
+)
+
+var neighbors = struct {
+	sync.Mutex
+	m map[string]cachedNeighbor
+}{m: map[string]cachedNeighbor{}}
+
+type cachedNeighbor struct {
+	nb      *neighbor
+	expires time.Time
+}
+
+// lookupNeighbor es readNeighbor con caché.
+func lookupNeighbor(ip net.IP) *neighbor {
+	key := ip.String()
+	now := time.Now()
+	neighbors.Lock()
+	c, ok := neighbors.m[key]
+	neighbors.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.nb
+	}
+
+	nb := readNeighbor(ip)
+	neighbors.Lock()
+	defer neighbors.Unlock()
+	if len(neighbors.m) >= maxNeighbors {
+		for k, c := range neighbors.m {
+			if !now.Before(c.expires) {
+				delete(neighbors.m, k)
+			}
+		}
+	}
+	if len(neighbors.m) < maxNeighbors {
+		neighbors.m[key] = cachedNeighbor{nb: nb, expires: now.Add(neighborTTL)}
+	}
+	return nb
+}
+
+// readNeighbor busca ip en la tabla de vecinos (ARP/NDP). Si no está, la
+// interfaz es la que tenga la subred de ip.
+func readNeighbor(ip net.IP) *neighbor {
+	nb := &neighbor{}
+
+	family := byte(unix.AF_INET)
+	if ip.To4() == nil {
+		family = unix.AF_INET6
+	}
+	body := make([]byte, unix.SizeofNdMsg)
+	body[0] = family
+	msgs, err := nlDump(unix.RTM_GETNEIGH, body)
+	if err == nil {
+		for _, m := range msgs {
+			if m.Header.Type != unix.RTM_NEWNEIGH || len(m.Data) < unix.SizeofNdMsg {
+				continue
+			}
+			dst, lladdr := neighAttrs(m)
+			if dst == nil || !dst.Equal(ip) {
+				continue
+			}
+			state := binary.NativeEndian.Uint16(m.Data[8:10])
+			if state&(unix.NUD_INCOMPLETE|unix.NUD_FAILED) != 0 {
+				continue
+			}
+			nb.mac = lladdr
+			if iface, err := net.InterfaceByIndex(int(int32(binary.NativeEndian.Uint32(m.Data[4:8])))); err == nil {
+				nb.iface = iface.Name
+			}
+			return nb
+		}
+	}
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, a := range addrs {
+			if ipn, ok := a.(*net.IPNet); ok && ipn.Contains(ip) {
+				nb.iface = iface.Name
+				return nb
+			}
+		}
+	}
+	return nb
+}
+
+// neighAttrs saca NDA_DST y NDA_LLADDR de un RTM_NEWNEIGH.
+func neighAttrs(m syscall.NetlinkMessage) (net.IP, net.HardwareAddr) {
+	var dst net.IP
+	var lladdr net.HardwareAddr
+	b := m.Data[unix.SizeofNdMsg:]
+	for len(b) >= unix.SizeofRtAttr {
+		l := int(binary.NativeEndian.Uint16(b[0:2]))
+		if l < unix.SizeofRtAttr || l > len(b) {
+			break
+		}
+		v := b[unix.SizeofRtAttr:l]
+		switch binary.NativeEndian.Uint16(b[2:4]) {
+		case unix.NDA_DST:
+			dst = net.IP(append([]byte(nil), v...))
+		case unix.NDA_LLADDR:
+			lladdr = net.HardwareAddr(append([]byte(nil), v...))
+		}
+		b = b[min((l+3)&^3, len(b)):]
+	}
+	return dst, lladdr
+}
+
+// restrictServices aplica las ACL a una respuesta para los clientes: las
+// instancias de un puerto con reglas se quitan de msg (que va por
+// multicast a todos) y se mandan por unicast, reescritas, sólo a los
+// clientes que las preguntaron y pueden usarlas. Los anuncios no pedidos
+// (y las despedidas) van igual a los clientes ya vistos que pueden usarlas,
+// para que no se queden con registros viejos.
+func restrictServices(msg *dns.Msg) []Packet {
+	if !msg.Response {
+		return nil
+	}
+	ports := map[string]int{} // instancia -> puerto anunciado
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range sec {
+			if srv, ok := rr.(*dns.SRV); ok {
+				ports[strings.ToLower(srv.Hdr.Name)] = int(advertisedPort(srv.Port))
+			}
+		}
+	}
+	if len(ports) == 0 {
+		return nil
+	}
+	// Las reglas son las del listener de la IP de proxy con que ve el
+	// servicio cada cliente: la suya o IpProxy.
+	ipProxy, _ := proxy()
+	rulesAt := map[string]map[string][]ACLRule{} // IP del proxy -> instancia -> reglas
+	rulesFor := func(ip net.IP) map[string][]ACLRule {
+		if r, ok := rulesAt[ip.String()]; ok {
+			return r
+		}
+		r := map[string][]ACLRule{}
+		for name, port := range ports {
+			if acl := aclForPort(ip, port); len(acl) > 0 {
+				r[name] = acl
+			}
+		}
+		rulesAt[ip.String()] = r
+		return r
+	}
+	all := map[string]bool{}
+	for _, ip := range append([]net.IP{ipProxy}, policyProxies()...) {
+		for name := range rulesFor(ip) {
+			all[name] = true
+		}
+	}
+	if len(all) == 0 {
+		return nil
+	}
+
+	full := msg.Copy()
+	dropInstances(msg, all)
+
+	recipients := queriersFor(full)
+	if len(recipients) == 0 {
+		recipients = knownClients()
+	}
+
+	var out []Packet
+	sent := map[string]bool{}
+	for _, q := range recipients {
+		if sent[q.addr.String()] {
+			continue
+		}
+		sent[q.addr.String()] = true
+
+		var proxyIP net.IP
+		at := ipProxy
+		if q.pol != nil {
+			proxyIP, at = q.pol.Proxy, q.pol.Proxy
+		}
+		rules := rulesFor(at)
+		denied := map[string]bool{}
+		for name := range all {
+			if ok, _ := allowed(rules[name], q.addr.IP); !ok {
+				denied[name] = true
+			}
+		}
+		if len(denied) == len(all) {
+			continue
+		}
+		m := full.Copy()
+		dropInstances(m, denied)
+		fmt.Printf("--- Para %s (ACL) ---\n", q.addr)
+		rewriteFor(m, ToClient, proxyIP)
+		b, err := m.Pack()
+		if err != nil {
+			continue
+		}
+		out = append(out, Packet{Data: b, To: q.addr, Iface: q.iface})
+	}
+	return out
+}
+
+// dropInstances quita de msg los registros de las instancias names: sus
+// SRV, TXT y los PTR que apuntan a ellas.
+func dropInstances(msg *dns.Msg, names map[string]bool) {
+	keep := func(rrs []dns.RR) []dns.RR {
+		var out []dns.RR
+		for _, rr := range rrs {
+			if ptr, ok := rr.(*dns.PTR); ok && names[strings.ToLower(ptr.Ptr)] {
+				continue
+			}
+			if names[strings.ToLower(rr.Header().Name)] {
+				continue
+			}
+			out = append(out, rr)
+		}
+		return out
+	}
+	msg.Answer = keep(msg.Answer)
+	msg.Extra = keep(msg.Extra)
+}
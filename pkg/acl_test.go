@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseACLRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		allow   bool
+		net     string
+		iface   string
+		mac     string
+		wantErr bool
+	}{
+		{in: "allow:192.168.1.0/24", allow: true, net: "192.168.1.0/24"},
+		{in: "deny:10.0.0.7", net: "10.0.0.7/32"},
+		{in: "allow:fd00::1", allow: true, net: "fd00::1/128"},
+		{in: "deny:iface=eth1", iface: "eth1"},
+		{in: "allow:mac=aa:bb:cc:dd:ee:ff", allow: true, mac: "aa:bb:cc:dd:ee:ff"},
+		{in: "deny:all"},
+		{in: "allow", wantErr: true},
+		{in: "permit:all", wantErr: true},
+		{in: "allow:mac=nada", wantErr: true},
+		{in: "allow:10.0.0.0/33", wantErr: true},
+		{in: "deny:equipo", wantErr: true},
+	}
+	for _, tt := range tests {
+		r, err := ParseACLRule(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseACLRule(%q) = %+v, se esperaba error", tt.in, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseACLRule(%q): %v", tt.in, err)
+			continue
+		}
+		var n, mac string
+		if r.Net != nil {
+			n = r.Net.String()
+		}
+		if r.MAC != nil {
+			mac = r.MAC.String()
+		}
+		if r.Allow != tt.allow || n != tt.net || r.Iface != tt.iface || mac != tt.mac {
+			t.Errorf("ParseACLRule(%q) = {allow %v net %q iface %q mac %q}, se esperaba {allow %v net %q iface %q mac %q}",
+				tt.in, r.Allow, n, r.Iface, mac, tt.allow, tt.net, tt.iface, tt.mac)
+		}
+		if r.String() != tt.in {
+			t.Errorf("ParseACLRule(%q).String() = %q", tt.in, r.String())
+		}
+	}
+}
+
+func TestParsePortACLRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		port    int
+		net     string
+		wantErr bool
+	}{
+		{in: "8009/allow:10.0.0.0/8", port: 8009, net: "10.0.0.0/8"},
+		{in: "allow:10.0.0.0/8", port: 0, net: "10.0.0.0/8"},
+		{in: "deny:10.0.0.1", port: 0, net: "10.0.0.1/32"},
+		{in: "70000/allow:all", wantErr: true},
+		{in: "8009/permit:all", wantErr: true},
+	}
+	for _, tt := range tests {
+		port, r, err := ParsePortACLRule(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePortACLRule(%q) = %d %+v, se esperaba error", tt.in, port, r)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePortACLRule(%q): %v", tt.in, err)
+			continue
+		}
+		if port != tt.port || r.Net == nil || r.Net.String() != tt.net {
+			t.Errorf("ParsePortACLRule(%q) = %d %v, se esperaba %d %s", tt.in, port, r.Net, tt.port, tt.net)
+		}
+	}
+}
+
+// Sólo reglas por subred y "all": las de interfaz y MAC consultan la tabla
+// de vecinos del kernel.
+func TestAllowed(t *testing.T) {
+	rules := func(ss ...string) []ACLRule {
+		var out []ACLRule
+		for _, s := range ss {
+			r, err := ParseACLRule(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, r)
+		}
+		return out
+	}
+	tests := []struct {
+		name  string
+		rules []ACLRule
+		ip    string
+		want  bool
+	}{
+		{"sin reglas", nil, "10.0.0.1", true},
+		{"allow encaja", rules("allow:10.0.0.0/8"), "10.1.2.3", true},
+		{"allow no encaja", rules("allow:10.0.0.0/8"), "192.168.1.1", false},
+		{"sólo deny, no encaja", rules("deny:10.0.0.0/8"), "192.168.1.1", true},
+		{"sólo deny, encaja", rules("deny:10.0.0.0/8"), "10.0.0.1", false},
+		{"gana la primera", rules("deny:10.0.0.1", "allow:10.0.0.0/8"), "10.0.0.1", false},
+		{"gana la primera (allow)", rules("allow:10.0.0.1", "deny:all"), "10.0.0.1", true},
+		{"deny all al final", rules("allow:10.0.0.0/8", "deny:all"), "172.16.0.1", false},
+		{"IPv6", rules("allow:fd00::/8"), "fd00::5", true},
+	}
+	for _, tt := range tests {
+		got, reason := allowed(tt.rules, net.ParseIP(tt.ip))
+		if got != tt.want {
+			t.Errorf("%s: allowed(%s) = %v (%q), se esperaba %v", tt.name, tt.ip, got, reason, tt.want)
+		}
+		if got != (reason == "") {
+			t.Errorf("%s: motivo %q con allowed = %v", tt.name, reason, got)
+		}
+	}
+}
+
+// Con varios reenvíos en el mismo puerto, las reglas son las del listener
+// de la IP del proxy; si no hay, las del que escucha en todas.
+func TestACLForPort(t *testing.T) {
+	at := func(ip string, rule string) *portListener {
+		var addr net.IP
+		if ip != "" {
+			addr = net.ParseIP(ip)
+		}
+		return &portListener{
+			ln:  fakeListener{&net.TCPAddr{IP: addr, Port: 8009}},
+			acl: []ACLRule{mustRule(t, rule)},
+		}
+	}
+	listeners.Lock()
+	listeners.m["test:a"] = at("10.0.0.5", "allow:192.168.1.0/24")
+	listeners.m["test:b"] = at("10.0.0.6", "allow:192.168.2.0/24")
+	listeners.m["test:c"] = at("0.0.0.0", "deny:all")
+	listeners.Unlock()
+	t.Cleanup(func() {
+		listeners.Lock()
+		for _, k := range []string{"test:a", "test:b", "test:c"} {
+			delete(listeners.m, k)
+		}
+		listeners.Unlock()
+	})
+
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"10.0.0.5", "allow:192.168.1.0/24"},
+		{"10.0.0.6", "allow:192.168.2.0/24"},
+		{"10.0.0.7", "deny:all"},
+	}
+	for _, tt := range tests {
+		rules := aclForPort(net.ParseIP(tt.ip), 8009)
+		if len(rules) != 1 || rules[0].String() != tt.want {
+			t.Errorf("aclForPort(%s, 8009) = %v, se esperaba [%s]", tt.ip, rules, tt.want)
+		}
+	}
+}
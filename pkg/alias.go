@@ -0,0 +1,335 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Aliases son las IPs de proxy añadidas como direcciones secundarias a la
+// interfaz de clientes, para quitarlas al salir.
+type Aliases struct {
+	iface *net.Interface
+	added []net.IP
+}
+
+// aliasIPs son las IPs que añade o quita el propio proxy (ip -> true).
+var aliasIPs sync.Map
+
+// isAlias indica si ip es una de las que añade el proxy.
+func isAlias(ip net.IP) bool {
+	_, ok := aliasIPs.Load(ip.String())
+	return ok
+}
+
+// AddAliases añade cada ip como /32 a la interfaz name, salvo las que ya
+// tenga. Antes comprueba por ARP que nadie más la use en el segmento y, tras
+// añadirla, la anuncia con ARP gratuito. Si alguna falla, deshace lo hecho.
+func AddAliases(name string, ips []net.IP) (*Aliases, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	a := &Aliases{iface: iface}
+
+	have := map[string]bool{}
+	if addrs, err := iface.Addrs(); err == nil {
+		for _, addr := range addrs {
+			if ipn, ok := addr.(*net.IPNet); ok {
+				have[ipn.IP.String()] = true
+			}
+		}
+	}
+
+	for _, ip := range ips {
+		ip = ip.To4()
+		if ip == nil || have[ip.String()] {
+			continue
+		}
+		have[ip.String()] = true
+
+		mac, err := arpProbe(iface, ip)
+		if err != nil {
+			a.Remove()
+			return nil, fmt.Errorf("no se pudo comprobar %s: %w", ip, err)
+		}
+		if mac != nil {
+			a.Remove()
+			return nil, fmt.Errorf("la IP %s ya la usa %s en %s", ip, mac, name)
+		}
+
+		// Antes de añadirla, para que su evento de netlink ya se reconozca.
+		aliasIPs.Store(ip.String(), true)
+		if err := addrRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, iface.Index, ip); err != nil {
+			a.Remove()
+			return nil, fmt.Errorf("no se pudo añadir %s a %s: %w", ip, name, err)
+		}
+		a.added = append(a.added, ip)
+		log.Printf("Añadida la IP %s a %s", ip, name)
+
+		if err := gratuitousARP(iface, ip); err != nil {
+			log.Printf("Error al enviar ARP gratuito de %s: %v", ip, err)
+		}
+	}
+	return a, nil
+}
+
+// Remove quita las direcciones que añadió AddAliases.
+func (a *Aliases) Remove() {
+	for _, ip := range a.added {
+		if err := addrRequest(unix.RTM_DELADDR, 0, a.iface.Index, ip); err != nil {
+			log.Printf("No se pudo quitar %s de %s: %v", ip, a.iface.Name, err)
+			continue
+		}
+		log.Printf("Quitada la IP %s de %s", ip, a.iface.Name)
+	}
+	a.added = nil
+}
+
+// addrRequest envía un RTM_NEWADDR/RTM_DELADDR para ip/32 y espera el ACK.
+func addrRequest(typ uint16, flags uint16, index int, ip net.IP) error {
+	// ifaddrmsg: familia, prefijo, flags, scope, índice.
+	body := make([]byte, unix.SizeofIfAddrmsg)
+	body[0] = unix.AF_INET
+	body[1] = 32
+	body[3] = unix.RT_SCOPE_UNIVERSE
+	binary.NativeEndian.PutUint32(body[4:8], uint32(index))
+	body = append(body, nlAttr(unix.IFA_LOCAL, ip)...)
+	body = append(body, nlAttr(unix.IFA_ADDRESS, ip)...)
+	return nlRequest(typ, flags, body)
+}
+
+// nlAttr codifica un atributo de netlink (rtattr).
+func nlAttr(t uint16, v []byte) []byte {
+	b := make([]byte, unix.SizeofRtAttr+len(v))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(len(b)))
+	binary.NativeEndian.PutUint16(b[2:4], t)
+	copy(b[4:], v)
+	// Los atributos van alineados a 4 bytes.
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// nlRequest envía una petición de tipo typ con body a NETLINK_ROUTE y espera
+// el ACK.
+func nlRequest(typ uint16, flags uint16, body []byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], 1)
+	msg = append(msg, body...)
+
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(fd, buf, 0)
+	if err != nil {
+		return err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Header.Type == unix.NLMSG_ERROR && len(m.Data) >= 4 {
+			if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("respuesta de netlink inesperada")
+}
+
+// nlDump pide a NETLINK_ROUTE un volcado (NLM_F_DUMP) de tipo typ y
+// devuelve todos los mensajes de la respuesta.
+func nlDump(typ uint16, body []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	msg := make([]byte, unix.SizeofNlMsghdr, unix.SizeofNlMsghdr+len(body))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(unix.SizeofNlMsghdr+len(body)))
+	binary.NativeEndian.PutUint16(msg[4:6], typ)
+	binary.NativeEndian.PutUint16(msg[6:8], unix.NLM_F_REQUEST|unix.NLM_F_DUMP)
+	binary.NativeEndian.PutUint32(msg[8:12], 1)
+	msg = append(msg, body...)
+
+	if err := unix.Sendto(fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return nil, err
+	}
+
+	var out []syscall.NetlinkMessage
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				return out, nil
+			case unix.NLMSG_ERROR:
+				if len(m.Data) >= 4 {
+					if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+						return nil, syscall.Errno(-errno)
+					}
+				}
+				return out, nil
+			}
+			out = append(out, m)
+		}
+	}
+}
+
+// Parámetros del sondeo ARP (RFC 5227, acortados).
+const (
+	arpProbes   = 3
+	arpInterval = 200 * time.Millisecond
+	arpWait     = time.Second
+)
+
+// arpProbe pregunta por ip con origen 0.0.0.0 y devuelve la MAC de quien
+// responda o la esté sondeando a la vez; nil si está libre.
+func arpProbe(iface *net.Interface, ip net.IP) (net.HardwareAddr, error) {
+	fd, err := arpSocket(iface)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+
+	tv := unix.NsecToTimeval(int64(50 * time.Millisecond))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		return nil, err
+	}
+
+	probe := arpPacket(iface.HardwareAddr, net.IPv4zero.To4(), ip)
+	sent := 0
+	var next time.Time
+	deadline := time.Now().Add(arpInterval*arpProbes + arpWait)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if sent < arpProbes && !time.Now().Before(next) {
+			if err := arpSend(fd, iface, probe); err != nil {
+				return nil, err
+			}
+			sent++
+			next = time.Now().Add(arpInterval)
+		}
+
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return nil, err
+		}
+		// Cabecera ethernet (14) + ARP IPv4 (28).
+		if n < 42 {
+			continue
+		}
+		arp := buf[14:42]
+		sha := net.HardwareAddr(append([]byte(nil), arp[8:14]...))
+		spa := net.IP(arp[14:18])
+		tpa := net.IP(arp[24:28])
+		if sha.String() == iface.HardwareAddr.String() {
+			continue
+		}
+		// Alguien la tiene, o la está sondeando como nosotros.
+		if spa.Equal(ip) || (spa.Equal(net.IPv4zero) && tpa.Equal(ip)) {
+			return sha, nil
+		}
+	}
+	return nil, nil
+}
+
+// gratuitousARP anuncia que ip está en la MAC de iface.
+func gratuitousARP(iface *net.Interface, ip net.IP) error {
+	fd, err := arpSocket(iface)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	pkt := arpPacket(iface.HardwareAddr, ip, ip)
+	for i := 0; i < 2; i++ {
+		if err := arpSend(fd, iface, pkt); err != nil {
+			return err
+		}
+		time.Sleep(arpInterval)
+	}
+	return nil
+}
+
+func arpSocket(iface *net.Interface) (int, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: iface.Index}); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+func arpSend(fd int, iface *net.Interface, pkt []byte) error {
+	to := &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ARP),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(to.Addr[:], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	return unix.Sendto(fd, pkt, 0, to)
+}
+
+// arpPacket construye una petición ARP en broadcast con emisor (mac, spa)
+// que pregunta por tpa.
+func arpPacket(mac net.HardwareAddr, spa, tpa net.IP) []byte {
+	b := make([]byte, 42)
+	copy(b[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(b[6:12], mac)
+	binary.BigEndian.PutUint16(b[12:14], unix.ETH_P_ARP)
+
+	arp := b[14:]
+	binary.BigEndian.PutUint16(arp[0:2], 1)      // ethernet
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800) // IPv4
+	arp[4] = 6
+	arp[5] = 4
+	binary.BigEndian.PutUint16(arp[6:8], 1) // petición
+	copy(arp[8:14], mac)
+	copy(arp[14:18], spa.To4())
+	copy(arp[24:28], tpa.To4())
+	return b
+}
+
+// htons pasa v a orden de red tal como lo espera AF_PACKET.
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
@@ -0,0 +1,57 @@
+package pkg
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// apiMux agrupa los endpoints HTTP de consulta del proxy.
+var apiMux = http.NewServeMux()
+
+func init() {
+	apiMux.HandleFunc("/inventory", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"hosts":    Assets.Hosts(),
+			"services": Assets.Services(),
+		})
+	})
+	apiMux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, Events())
+	})
+	apiMux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, Sessions())
+	})
+	apiMux.HandleFunc("/upstreams", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, Upstreams())
+	})
+	apiMux.HandleFunc("/records", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, DeviceRecords())
+	})
+	apiMux.HandleFunc("/udp", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, UDPSessions())
+	})
+	apiMux.HandleFunc("/inventory/hosts.csv", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		Assets.WriteHostsCSV(w)
+	})
+	apiMux.HandleFunc("/inventory/services.csv", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		Assets.WriteServicesCSV(w)
+	})
+}
+
+// ServeAPI expone la API HTTP en addr. Bloquea.
+func ServeAPI(addr string) error {
+	log.Printf("API escuchando en %s", addr)
+	return http.ListenAndServe(addr, apiMux)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Printf("Error al codificar la respuesta de la API: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+var (
+	proxyIfaceMu sync.Mutex
+	proxyIface   string
+)
+
+// AutoProxy toma IpProxy (y IpProxy6) de las direcciones de la interfaz name
+// y las mantiene al día con HandleAddrProxy.
+func AutoProxy(name string) error {
+	proxyIfaceMu.Lock()
+	proxyIface = name
+	proxyIfaceMu.Unlock()
+	return refreshProxy()
+}
+
+// HandleAddrProxy vuelve a calcular la IP del proxy si cambian las
+// direcciones de la interfaz elegida con AutoProxy.
+func HandleAddrProxy(ev AddrEvent) {
+	proxyIfaceMu.Lock()
+	name := proxyIface
+	proxyIfaceMu.Unlock()
+	if name == "" {
+		return
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil || iface.Index != ev.Index {
+		return
+	}
+	if err := refreshProxy(); err != nil {
+		log.Printf("No se pudo actualizar la IP del proxy: %v", err)
+	}
+}
+
+func refreshProxy() error {
+	proxyIfaceMu.Lock()
+	name := proxyIface
+	proxyIfaceMu.Unlock()
+
+	ip4, ip6, err := PrimaryAddrs(name)
+	if err != nil {
+		return err
+	}
+	if ip4 == nil {
+		return fmt.Errorf("la interfaz %s no tiene dirección IPv4", name)
+	}
+
+	old, _ := proxy()
+	oldV6 := proxy6()
+	if ip4.Equal(old) && ip6.Equal(oldV6) {
+		return nil
+	}
+	SetProxy(ip4, ip6)
+	log.Printf("IP del proxy: %s %s", ip4, ip6)
+	return nil
+}
+
+// PrimaryAddrs devuelve la primera IPv4 y la IPv6 preferida (global antes
+// que de enlace local) de una interfaz.
+func PrimaryAddrs(name string) (net.IP, net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ip4, ip6, ll6 net.IP
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipn.IP
+		switch {
+		case ip.To4() != nil:
+			if ip4 == nil && !ip.IsLinkLocalUnicast() {
+				ip4 = ip.To4()
+			}
+		case ip.IsLinkLocalUnicast():
+			if ll6 == nil {
+				ll6 = ip
+			}
+		case ip.IsGlobalUnicast():
+			if ip6 == nil {
+				ip6 = ip
+			}
+		}
+	}
+	if ip6 == nil {
+		ip6 = ll6
+	}
+	return ip4, ip6, nil
+}
@@ -0,0 +1,243 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ClientPolicy hace que los clientes de una subred vean al dispositivo a
+// través de otro proxy.
+type ClientPolicy struct {
+	Subnet *net.IPNet
+	Proxy  net.IP
+}
+
+// ClientPolicies son las políticas por cliente; si ninguna coincide se usa
+// IpProxy.
+var ClientPolicies []ClientPolicy
+
+// ParseClientPolicy lee "10.1.0.0/16=10.1.0.5" (o una IP suelta en lugar
+// de la subred).
+func ParseClientPolicy(s string) (ClientPolicy, error) {
+	subnet, proxyIP, ok := strings.Cut(s, "=")
+	if !ok {
+		return ClientPolicy{}, fmt.Errorf("falta '=' en %q", s)
+	}
+	if !strings.Contains(subnet, "/") {
+		if ip := net.ParseIP(subnet); ip != nil && ip.To4() != nil {
+			subnet += "/32"
+		} else {
+			subnet += "/128"
+		}
+	}
+	_, n, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return ClientPolicy{}, err
+	}
+	ip := net.ParseIP(proxyIP).To4()
+	if ip == nil {
+		return ClientPolicy{}, fmt.Errorf("IP de proxy no válida %q", proxyIP)
+	}
+	return ClientPolicy{Subnet: n, Proxy: ip}, nil
+}
+
+// policyFor devuelve la política más específica para ip, o nil.
+func policyFor(ip net.IP) *ClientPolicy {
+	var best *ClientPolicy
+	bestOnes := -1
+	for i := range ClientPolicies {
+		p := &ClientPolicies[i]
+		if !p.Subnet.Contains(ip) {
+			continue
+		}
+		if ones, _ := p.Subnet.Mask.Size(); ones > bestOnes {
+			best, bestOnes = p, ones
+		}
+	}
+	return best
+}
+
+// policyProxies devuelve las IPs de proxy de ClientPolicies.
+func policyProxies() []net.IP {
+	out := make([]net.IP, 0, len(ClientPolicies))
+	for _, p := range ClientPolicies {
+		out = append(out, p.Proxy)
+	}
+	return out
+}
+
+// querierWindow es cuánto tiempo se asocia una respuesta a quien preguntó.
+const querierWindow = 3 * time.Second
+
+// pendingQuery es una pregunta reciente de un cliente.
+type pendingQuery struct {
+	addr      *net.UDPAddr
+	iface     string
+	pol       *ClientPolicy // nil si el cliente usa IpProxy
+	questions []dns.Question
+	at        time.Time
+}
+
+var pending = struct {
+	sync.Mutex
+	list []pendingQuery
+}{}
+
+// Clientes mDNS vistos, a los que se mandan por unicast los anuncios no
+// pedidos de los servicios con ACL: se recuerdan durante seenClientTTL y,
+// como mucho, maxSeenClients.
+const (
+	seenClientTTL  = time.Hour
+	maxSeenClients = 512
+)
+
+var seenClients = struct {
+	sync.Mutex
+	m map[string]pendingQuery // IP -> última pregunta
+}{m: map[string]pendingQuery{}}
+
+// rememberQuerier apunta quién pregunta para dirigirle luego la respuesta
+// del dispositivo con su política o, si el servicio tiene ACL, sólo a él.
+func rememberQuerier(msg *dns.Msg, src *net.UDPAddr, iface string) {
+	if (len(ClientPolicies) == 0 && !haveACLs()) || msg.Response || len(msg.Question) == 0 || src == nil {
+		return
+	}
+	pol := policyFor(src.IP)
+
+	now := time.Now()
+	q := pendingQuery{
+		addr:      src,
+		iface:     iface,
+		pol:       pol,
+		questions: append([]dns.Question(nil), msg.Question...),
+		at:        now,
+	}
+	pending.Lock()
+	expirePending(now)
+	pending.list = append(pending.list, q)
+	pending.Unlock()
+
+	if haveACLs() {
+		rememberClient(q)
+	}
+}
+
+// rememberClient apunta que q.addr es un cliente mDNS. Se le escribirá al
+// puerto de mDNS, no al de la pregunta, que puede ser efímero.
+func rememberClient(q pendingQuery) {
+	q.addr = &net.UDPAddr{IP: q.addr.IP, Port: MdnsGroup.Port}
+	q.questions = nil
+
+	seenClients.Lock()
+	defer seenClients.Unlock()
+	key := q.addr.IP.String()
+	if _, ok := seenClients.m[key]; !ok && len(seenClients.m) >= maxSeenClients {
+		for k, c := range seenClients.m {
+			if q.at.Sub(c.at) >= seenClientTTL {
+				delete(seenClients.m, k)
+			}
+		}
+		if len(seenClients.m) >= maxSeenClients {
+			return
+		}
+	}
+	seenClients.m[key] = q
+}
+
+// knownClients devuelve los clientes mDNS vistos en la última seenClientTTL.
+func knownClients() []pendingQuery {
+	now := time.Now()
+	seenClients.Lock()
+	defer seenClients.Unlock()
+	var out []pendingQuery
+	for k, c := range seenClients.m {
+		if now.Sub(c.at) >= seenClientTTL {
+			delete(seenClients.m, k)
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func expirePending(now time.Time) {
+	keep := pending.list[:0]
+	for _, p := range pending.list {
+		if now.Sub(p.at) < querierWindow {
+			keep = append(keep, p)
+		}
+	}
+	pending.list = keep
+}
+
+// queriersFor devuelve los clientes que preguntaron por algo de lo que
+// trae la respuesta.
+func queriersFor(msg *dns.Msg) []pendingQuery {
+	pending.Lock()
+	defer pending.Unlock()
+	expirePending(time.Now())
+
+	var out []pendingQuery
+	for _, p := range pending.list {
+		if answersAny(msg, p.questions) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func answersAny(msg *dns.Msg, qs []dns.Question) bool {
+	for _, rr := range msg.Answer {
+		for _, q := range qs {
+			if !strings.EqualFold(rr.Header().Name, q.Name) {
+				continue
+			}
+			if q.Qtype == dns.TypeANY || q.Qtype == rr.Header().Rrtype {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// audiencePackets genera una copia de la respuesta para cada cliente con
+// política que la pidió, reescrita con su proxy y enviada por unicast para
+// que no la vean los demás. El booleano indica si además hay que mandar la
+// copia normal por multicast (respuestas no solicitadas, o pedidas también
+// por clientes sin política).
+func audiencePackets(msg *dns.Msg, dir Direction) ([]Packet, bool) {
+	if !msg.Response || len(ClientPolicies) == 0 {
+		return nil, true
+	}
+	queriers := queriersFor(msg)
+	if len(queriers) == 0 {
+		return nil, true
+	}
+
+	var out []Packet
+	multicast := false
+	copies := map[*ClientPolicy][]byte{}
+	for _, q := range queriers {
+		if q.pol == nil {
+			// Lo pidió también alguien sin política: va la copia normal.
+			multicast = true
+			continue
+		}
+		b, ok := copies[q.pol]
+		if !ok {
+			m := msg.Copy()
+			fmt.Printf("--- Para %s (proxy %s) ---\n", q.pol.Subnet, q.pol.Proxy)
+			rewriteFor(m, dir, q.pol.Proxy)
+			b, _ = m.Pack()
+			copies[q.pol] = b
+		}
+		out = append(out, Packet{Data: b, To: q.addr, Iface: q.iface})
+	}
+
+	return out, multicast
+}
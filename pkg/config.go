@@ -1,9 +1,101 @@
 package pkg
 
-import "net"
+import (
+	"errors"
+	"net"
+	"sync"
+)
 
-var IpDevice = net.IPv4(0, 0, 0, 0)
-var PtrDevice = "0.0.0.0.in-addr.arpa."
+// IpDevice es la IP del dispositivo; nil mientras no se conozca (cuando se
+// busca por nombre).
+var IpDevice net.IP
+var PtrDevice string
 
 var IpProxy = net.IPv4(0, 0, 0, 0)
 var PtrProxy = "0.0.0.0.in-addr.arpa."
+
+// IpProxy6 es la dirección IPv6 del proxy, si la hay.
+var IpProxy6 net.IP
+
+// errNoDevice es el error de las conexiones que llegan antes de conocer la
+// IP del dispositivo: se rechazan en lugar de conectar con 0.0.0.0 (que es
+// el propio proxy).
+var errNoDevice = errors.New("aún no se conoce la IP del dispositivo")
+
+// addrMu protege las variables anteriores cuando se actualizan en caliente
+// (DHCP, resolución por nombre...).
+var addrMu sync.RWMutex
+
+// SetDevice cambia la IP del dispositivo y su PTR.
+func SetDevice(ip net.IP) {
+	addrMu.Lock()
+	defer addrMu.Unlock()
+	IpDevice = ip
+	PtrDevice = IpToPtr(ip)
+}
+
+// SetProxy cambia las IPs del proxy y su PTR.
+func SetProxy(ip4, ip6 net.IP) {
+	addrMu.Lock()
+	defer addrMu.Unlock()
+	IpProxy = ip4
+	PtrProxy = IpToPtr(ip4)
+	IpProxy6 = ip6
+}
+
+// device devuelve la IP del dispositivo y su PTR, o nil y "" si aún no se
+// conoce.
+func device() (net.IP, string) {
+	addrMu.RLock()
+	defer addrMu.RUnlock()
+	return IpDevice, PtrDevice
+}
+
+// proxy devuelve la IP del proxy y su PTR.
+func proxy() (net.IP, string) {
+	addrMu.RLock()
+	defer addrMu.RUnlock()
+	return IpProxy, PtrProxy
+}
+
+// proxy6 devuelve la IPv6 del proxy.
+func proxy6() net.IP {
+	addrMu.RLock()
+	defer addrMu.RUnlock()
+	return IpProxy6
+}
+
+// DeviceIface es la interfaz de los dispositivos. Lo que abre puertos o
+// decide a dónde se conecta (SRV, líderes de grupo) sólo se aprende de lo
+// que entra por ella.
+var DeviceIface string
+
+// fromDevices indica si un paquete recibido de src por iface viene de los
+// dispositivos: por su interfaz y desde su subred o una IP conocida.
+func fromDevices(src *net.UDPAddr, iface string) bool {
+	if src == nil || DeviceIface == "" || iface != DeviceIface {
+		return false
+	}
+	if ip, _ := device(); ip.Equal(src.IP) {
+		return true
+	}
+	return onDeviceSegment(src.IP)
+}
+
+// onDeviceSegment indica si ip está en alguna subred de DeviceIface.
+func onDeviceSegment(ip net.IP) bool {
+	iface, err := net.InterfaceByName(DeviceIface)
+	if err != nil {
+		return false
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
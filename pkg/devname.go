@@ -0,0 +1,182 @@
+package pkg
+
+import (
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DeviceServices son los tipos de servicio que se preguntan para encontrar
+// al dispositivo por su nombre.
+var DeviceServices = []string{"_googlecast._tcp.local."}
+
+// devName sigue al dispositivo identificado por nombre: se queda con lo que
+// anuncia cada instancia (SRV/TXT) y con las direcciones de cada host hasta
+// que caduca su TTL.
+type devName struct {
+	mu      sync.Mutex
+	name    string
+	target  map[string]string    // instancia -> host del SRV
+	txt     map[string][]string  // instancia -> TXT
+	hosts   map[string]net.IP    // host -> IPv4
+	expires map[string]time.Time // tipo|nombre -> caducidad
+}
+
+var byName = &devName{
+	target:  map[string]string{},
+	txt:     map[string][]string{},
+	hosts:   map[string]net.IP{},
+	expires: map[string]time.Time{},
+}
+
+// DeviceByName hace que IpDevice se resuelva por mDNS a partir del nombre de
+// instancia, del nombre amigable (fn=) o del id= del TXT, y que se actualice
+// si cambia. Las preguntas las hace el Querier, que pregunta más a menudo
+// mientras no se conozca el dispositivo.
+func DeviceByName(name string) {
+	byName.mu.Lock()
+	byName.name = name
+	byName.mu.Unlock()
+}
+
+// observe aprende de una respuesta mDNS y actualiza IpDevice si la
+// instancia buscada apunta a otra dirección.
+func (d *devName) observe(msg *dns.Msg) {
+	if !msg.Response {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.name == "" {
+		return
+	}
+
+	now := time.Now()
+	d.expire(now)
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range sec {
+			name := strings.ToLower(rr.Header().Name)
+			key := dns.TypeToString[rr.Header().Rrtype] + "|" + name
+			if rr.Header().Ttl == 0 {
+				// Despedida: deja de valer lo que sabíamos.
+				if _, ok := d.expires[key]; ok {
+					d.expires[key] = now
+				}
+				continue
+			}
+			switch r := rr.(type) {
+			case *dns.SRV:
+				d.target[name] = strings.ToLower(r.Target)
+			case *dns.TXT:
+				d.txt[name] = r.Txt
+			case *dns.A:
+				d.hosts[name] = r.A.To4()
+			default:
+				continue
+			}
+			d.expires[key] = now.Add(time.Duration(rr.Header().Ttl) * time.Second)
+		}
+	}
+	d.expire(now)
+
+	// En orden, para que con varias instancias que encajen gane siempre la
+	// misma.
+	insts := make([]string, 0, len(d.target))
+	for inst := range d.target {
+		insts = append(insts, inst)
+	}
+	sort.Strings(insts)
+	for _, inst := range insts {
+		if !d.matches(inst) {
+			continue
+		}
+		host := d.target[inst]
+		ip := d.hosts[host]
+		if ip == nil {
+			continue
+		}
+		if cur, _ := device(); !cur.Equal(ip) {
+			log.Printf("Dispositivo %q en %s (%s)", d.name, ip, host)
+			SetDevice(ip)
+		}
+		return
+	}
+}
+
+// expire olvida lo que ha caducado. Se llama con d bloqueado.
+func (d *devName) expire(now time.Time) {
+	for key, t := range d.expires {
+		if now.Before(t) {
+			continue
+		}
+		delete(d.expires, key)
+		typ, name, _ := strings.Cut(key, "|")
+		switch typ {
+		case "SRV":
+			delete(d.target, name)
+		case "TXT":
+			delete(d.txt, name)
+		case "A":
+			delete(d.hosts, name)
+		}
+	}
+}
+
+// matches indica si la instancia es la que buscamos.
+func (d *devName) matches(inst string) bool {
+	if labels := dns.SplitDomainName(inst); len(labels) > 0 &&
+		strings.EqualFold(unescapeLabel(labels[0]), d.name) {
+		return true
+	}
+	for _, kv := range d.txt[inst] {
+		k, v, _ := strings.Cut(kv, "=")
+		if (k == "id" || k == "fn") && strings.EqualFold(v, d.name) {
+			return true
+		}
+	}
+	return false
+}
+
+// active indica si el dispositivo se sigue por nombre.
+func (d *devName) active() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.name != ""
+}
+
+// searching indica si se busca el dispositivo por nombre y aún no se ha
+// encontrado.
+func (d *devName) searching() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ip, _ := device()
+	return d.name != "" && ip == nil
+}
+
+// unescapeLabel deshace el escapado de miekg/dns (\  y \DDD) de una etiqueta.
+func unescapeLabel(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 >= len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+			b.WriteByte((s[i+1]-'0')*100 + (s[i+2]-'0')*10 + (s[i+3] - '0'))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i+1])
+		i++
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DrainTimeout es cuánto se espera al apagar a que terminen las sesiones
+// TCP abiertas antes de cortarlas.
+var DrainTimeout = 10 * time.Second
+
+// tcpSession es una conexión aceptada, desde que se acepta (cabecera
+// PROXY, conexión con el destino...) hasta que termina.
+type tcpSession struct {
+	listen string
+	start  time.Time
+	quiet  bool // no registrar el resumen en el log
+	done   chan struct{}
+	ctx    context.Context // se cancela al cortarla
+	cancel context.CancelFunc
+
+	mu               sync.Mutex
+	client, upstream net.Conn // upstream es nil hasta conectar con el destino
+	reason           string   // por qué terminó; gana el primero
+	tls              *TLSInfo // sólo en el proxy MITM
+}
+
+var sessions = struct {
+	sync.Mutex
+	m map[*tcpSession]bool
+}{m: map[*tcpSession]bool{}}
+
+// trackSession registra la conexión client recién aceptada; hay que llamar
+// a finish (o a abort) al terminar.
+func trackSession(listen string, client net.Conn, quiet bool) *tcpSession {
+	s := &tcpSession{listen: listen, client: client, start: time.Now(), quiet: quiet, done: make(chan struct{})}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	sessions.Lock()
+	sessions.m[s] = true
+	sessions.Unlock()
+	return s
+}
+
+// setConns cambia las conexiones de la sesión: la del cliente tras leer la
+// cabecera PROXY y la del destino al conectar.
+func (s *tcpSession) setConns(client, upstream net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client, s.upstream = client, upstream
+}
+
+// kill corta la sesión, esté en la fase que esté.
+func (s *tcpSession) kill(reason string) {
+	s.setReason(reason)
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.client.Close()
+	if s.upstream != nil {
+		s.upstream.Close()
+	}
+}
+
+// abort termina una sesión que no llegó a reenviar nada.
+func (s *tcpSession) abort(reason string) {
+	s.kill(reason)
+	s.finish(0, 0)
+}
+
+// otherListeners son los listeners que no lleva Redirect (el del proxy
+// MITM) y que shutdownTCP también cierra.
+var otherListeners = struct {
+	sync.Mutex
+	list []net.Listener
+}{}
+
+// drainListener hace que shutdownTCP cierre ln. Devuelve false si ya se está
+// apagando.
+func drainListener(ln net.Listener) bool {
+	listeners.Lock()
+	defer listeners.Unlock()
+	if listeners.closed {
+		return false
+	}
+	otherListeners.Lock()
+	otherListeners.list = append(otherListeners.list, ln)
+	otherListeners.Unlock()
+	return true
+}
+
+var shutdownOnce sync.Once
+
+// shutdownTCP deja de aceptar conexiones, espera hasta DrainTimeout a que
+// terminen las sesiones abiertas y corta las que queden. Se puede llamar
+// varias veces (Redirect y RedirectTLS): sólo apaga la primera y las demás
+// esperan a que termine.
+func shutdownTCP() {
+	shutdownOnce.Do(drainTCP)
+}
+
+func drainTCP() {
+	listeners.Lock()
+	listeners.closed = true
+	for addr, l := range listeners.m {
+		l.ln.Close()
+		delete(listeners.m, addr)
+	}
+	otherListeners.Lock()
+	for _, ln := range otherListeners.list {
+		ln.Close()
+	}
+	otherListeners.list = nil
+	otherListeners.Unlock()
+	listeners.Unlock()
+
+	sessions.Lock()
+	active := make([]*tcpSession, 0, len(sessions.m))
+	for s := range sessions.m {
+		active = append(active, s)
+	}
+	sessions.Unlock()
+	log.Printf("Apagando: esperando a %d sesiones TCP (máximo %s)", len(active), DrainTimeout)
+
+	deadline := time.After(DrainTimeout)
+	drained, killed := 0, 0
+	for _, s := range active {
+		select {
+		case <-s.done:
+			drained++
+			continue
+		case <-deadline:
+		}
+		// Se acabó el plazo: cortamos esta y las que queden.
+		deadline = closedChan
+		select {
+		case <-s.done:
+			drained++
+		default:
+			s.kill("apagado")
+			<-s.done
+			killed++
+		}
+	}
+
+	log.Printf("Sesiones TCP: %d terminadas, %d cortadas", drained, killed)
+	Emit("shutdown", "Proxy TCP apagado", map[string]string{
+		"drained": strconv.Itoa(drained),
+		"killed":  strconv.Itoa(killed),
+	})
+}
+
+// closedChan está siempre listo para leer.
+var closedChan = func() <-chan time.Time {
+	c := make(chan time.Time)
+	close(c)
+	return c
+}()
@@ -0,0 +1,93 @@
+package pkg
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Al apagar, la sesión que termina dentro del plazo acaba sola, la que
+// sigue abierta se corta y el listener deja de aceptar.
+func TestDrainTCP(t *testing.T) {
+	timeout := DrainTimeout
+	DrainTimeout = 300 * time.Millisecond
+	t.Cleanup(func() {
+		DrainTimeout = timeout
+		listeners.Lock()
+		listeners.closed = false
+		listeners.Unlock()
+	})
+
+	reasons := make(chan string, 2)
+	OnSession(func(rec SessionRecord) {
+		if rec.Listen != "127.0.0.1:0" {
+			return
+		}
+		select {
+		case reasons <- rec.Reason:
+		default: // de otra ejecución del test
+		}
+	})
+
+	up := upstreamServer(t, func(c net.Conn) { io.Copy(c, c) })
+	addr := startListener(t, &portListener{pool: newPool("", CheckNone, fixedAddr(up))})
+
+	// Dos clientes con la sesión ya en marcha (el eco ha vuelto).
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(c, "x")
+		if _, err := io.ReadFull(c, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	quick, stuck := dial(), dial()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		quick.Close()
+	}()
+
+	start := time.Now()
+	drainTCP()
+	if d := time.Since(start); d < DrainTimeout {
+		t.Errorf("drainTCP volvió a los %s, antes del plazo de %s", d, DrainTimeout)
+	}
+
+	// A la sesión cortada se le cierra la conexión.
+	if _, err := stuck.Read(make([]byte, 1)); err == nil {
+		t.Error("la sesión pendiente sigue abierta tras apagar")
+	}
+	if _, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		t.Error("el listener sigue aceptando tras apagar")
+	}
+	if err := listen(&portListener{addr: "127.0.0.1:0"}); err == nil {
+		t.Error("se pudo abrir un listener tras apagar")
+	}
+
+	var got []string
+	for range 2 {
+		select {
+		case r := <-reasons:
+			got = append(got, r)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sólo terminaron %d sesiones", len(got))
+		}
+	}
+	if !slices.Contains(got, "apagado") {
+		t.Errorf("motivos = %v, se esperaba uno \"apagado\"", got)
+	}
+
+	evs := Events()
+	last := evs[len(evs)-1]
+	if want := map[string]string{"drained": "1", "killed": "1"}; last.Type != "shutdown" || !reflect.DeepEqual(last.Fields, want) {
+		t.Errorf("último evento = %s %v, se esperaba shutdown %v", last.Type, last.Fields, want)
+	}
+}
@@ -0,0 +1,45 @@
+package pkg
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Event es un suceso notable (suplantación, conflicto...) que se registra y
+// se puede consultar por la API.
+type Event struct {
+	Time    time.Time         `json:"time"`
+	Type    string            `json:"type"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// maxEvents es cuántos eventos se guardan en memoria.
+const maxEvents = 1000
+
+var (
+	eventsMu sync.Mutex
+	events   []Event
+)
+
+// Emit registra un evento y lo muestra en el log.
+func Emit(typ, message string, fields map[string]string) {
+	ev := Event{Time: time.Now(), Type: typ, Message: message, Fields: fields}
+	log.Printf("%s %s %v", red("["+typ+"]"), message, fields)
+
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	events = append(events, ev)
+	if len(events) > maxEvents {
+		events = events[len(events)-maxEvents:]
+	}
+}
+
+// Events devuelve una copia de los eventos guardados, del más antiguo al
+// más reciente.
+func Events() []Event {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	return append([]Event(nil), events...)
+}
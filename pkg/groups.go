@@ -0,0 +1,227 @@
+package pkg
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Los grupos de altavoces Cast se anuncian como una instancia más de
+// _googlecast._tcp, con md=Google Cast Group en el TXT y un puerto dinámico,
+// alojada por el miembro que hace de líder en cada momento.
+
+// castGroup es un grupo Cast conocido.
+type castGroup struct {
+	port    uint16
+	leader  string // host del SRV (el líder actual)
+	isGroup bool   // el TXT dice que es un grupo
+}
+
+// groupHostIP es la IPv4 de un host y hasta cuándo vale.
+type groupHostIP struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// Máximo de grupos y de hosts que se recuerdan, para que un segmento
+// ruidoso no haga crecer los mapas sin fin.
+const (
+	maxGroups     = 64
+	maxGroupHosts = 256
+)
+
+var groups = struct {
+	sync.Mutex
+	m     map[string]*castGroup  // instancia -> grupo
+	hosts map[string]groupHostIP // host -> IPv4
+}{
+	m:     map[string]*castGroup{},
+	hosts: map[string]groupHostIP{},
+}
+
+func init() {
+	OnPacket(watchGroups)
+}
+
+// watchGroups sigue los grupos Cast: su puerto, su líder y la IP del líder,
+// y abre un puerto que reenvía al líder actual. Sólo aprende de los
+// dispositivos y sólo acepta líderes de su subred: si no, cualquiera podría
+// hacer que el proxy reenviase a donde quisiera.
+func watchGroups(msg *dns.Msg, src *net.UDPAddr, iface string) {
+	if !msg.Response || !fromDevices(src, iface) {
+		return
+	}
+
+	groups.Lock()
+	defer groups.Unlock()
+
+	now := time.Now()
+	for name, h := range groups.hosts {
+		if now.After(h.expires) {
+			delete(groups.hosts, name)
+		}
+	}
+
+	var bye []uint16
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range sec {
+			name := strings.ToLower(rr.Header().Name)
+			switch r := rr.(type) {
+			case *dns.A:
+				if r.Hdr.Ttl == 0 {
+					delete(groups.hosts, name)
+					continue
+				}
+				if !onDeviceSegment(r.A) {
+					continue
+				}
+				if _, ok := groups.hosts[name]; !ok && len(groups.hosts) >= maxGroupHosts {
+					continue
+				}
+				groups.hosts[name] = groupHostIP{
+					ip:      r.A.To4(),
+					expires: now.Add(time.Duration(r.Hdr.Ttl) * time.Second),
+				}
+			case *dns.SRV:
+				if !strings.HasSuffix(name, "._googlecast._tcp.local.") {
+					continue
+				}
+				g := groupFor(name)
+				if g == nil {
+					continue
+				}
+				if r.Hdr.Ttl == 0 {
+					if g.isGroup {
+						bye = append(bye, g.port)
+					}
+					delete(groups.m, name)
+					continue
+				}
+				if g.leader != "" && g.leader != strings.ToLower(r.Target) {
+					log.Printf("Nuevo líder del grupo %s: %s", name, r.Target)
+				}
+				g.port = r.Port
+				g.leader = strings.ToLower(r.Target)
+			case *dns.TXT:
+				if !strings.HasSuffix(name, "._googlecast._tcp.local.") {
+					continue
+				}
+				for _, kv := range r.Txt {
+					if kv != "md=Google Cast Group" {
+						continue
+					}
+					if g := groupFor(name); g != nil {
+						g.isGroup = true
+					}
+				}
+			}
+		}
+	}
+
+	for _, port := range bye {
+		closePort(int(port))
+	}
+
+	for name, g := range groups.m {
+		if !g.isGroup || g.port == 0 || groups.hosts[g.leader].ip == nil {
+			continue
+		}
+		port := g.port
+		ttl := groupTTL(msg, name)
+		if ttl == 0 {
+			continue
+		}
+		if err := openPort(int(port), ttl, func() net.IP { return groupLeader(port) }); err != nil {
+			log.Printf("No se pudo escuchar en el puerto del grupo %s (%d): %v", name, port, err)
+		}
+		// Nombre propio para el grupo, que el responder contesta con el proxy.
+		AddHostname(groupHost(port))
+	}
+}
+
+// groupFor devuelve (creándolo) el grupo de la instancia name, o nil si ya
+// hay maxGroups. Se llama con groups bloqueado.
+func groupFor(name string) *castGroup {
+	g, ok := groups.m[name]
+	if !ok {
+		if len(groups.m) >= maxGroups {
+			return nil
+		}
+		g = &castGroup{}
+		groups.m[name] = g
+	}
+	return g
+}
+
+// groupTTL es el TTL del SRV del grupo en msg, o 0 si no viene.
+func groupTTL(msg *dns.Msg, name string) time.Duration {
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range sec {
+			if srv, ok := rr.(*dns.SRV); ok && strings.EqualFold(srv.Hdr.Name, name) {
+				return time.Duration(srv.Hdr.Ttl) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
+// groupLeader devuelve la IP del líder actual del grupo del puerto port.
+func groupLeader(port uint16) net.IP {
+	groups.Lock()
+	defer groups.Unlock()
+	for _, g := range groups.m {
+		if g.isGroup && g.port == port {
+			return groups.hosts[g.leader].ip
+		}
+	}
+	return nil
+}
+
+// groupHost es el nombre de host con el que anunciamos el grupo del
+// puerto port a los clientes.
+func groupHost(port uint16) string {
+	return fmt.Sprintf("cast-group-%d.local.", port)
+}
+
+// rewriteGroups hace que los registros de los grupos apunten al proxy: el
+// SRV pasa a un nombre propio del grupo, con su A hacia el proxy, en lugar
+// del host del líder.
+func rewriteGroups(msg *dns.Msg) {
+	if !msg.Response {
+		return
+	}
+	ipProxy, _ := proxy()
+
+	groups.Lock()
+	defer groups.Unlock()
+
+	var extra []dns.RR
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for i, rr := range sec {
+			srv, ok := rr.(*dns.SRV)
+			if !ok {
+				continue
+			}
+			g, ok := groups.m[strings.ToLower(srv.Hdr.Name)]
+			if !ok || !g.isGroup {
+				continue
+			}
+			n := dns.Copy(srv).(*dns.SRV)
+			n.Target = groupHost(srv.Port)
+			sec[i] = n
+			fmt.Printf("	-%s\n", red(srv.String()))
+			fmt.Printf("	+%s\n", blue(n.String()))
+
+			extra = append(extra, &dns.A{
+				Hdr: dns.RR_Header{Name: n.Target, Rrtype: dns.TypeA, Class: dns.ClassINET | cacheFlush, Ttl: hostTTL},
+				A:   ipProxy,
+			})
+		}
+	}
+	msg.Extra = append(msg.Extra, extra...)
+}
@@ -0,0 +1,387 @@
+package pkg
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Reparto de conexiones entre los destinos de un listener.
+const (
+	BalanceFailover   = "failover"   // el primero sano, en orden
+	BalanceRoundRobin = "roundrobin" // por turnos entre los sanos
+)
+
+// Comprobaciones de salud de los destinos.
+const (
+	CheckTCP  = "tcp"  // que acepte la conexión
+	CheckTLS  = "tls"  // que además complete el handshake TLS
+	CheckNone = "none" // sólo cuentan los fallos al conectar
+)
+
+// HealthInterval es cada cuánto se comprueban los destinos.
+var HealthInterval = 10 * time.Second
+
+// DeviceReplicas son otras IPs que sirven lo mismo que el dispositivo; los
+// puertos del perfil y de los SRV reparten entre él y ellas.
+var DeviceReplicas []net.IP
+
+// DeviceBalance y DeviceCheck son el reparto y la comprobación de los
+// puertos del perfil y de los SRV.
+var (
+	DeviceBalance = BalanceFailover
+	DeviceCheck   = CheckTCP
+)
+
+// upstream es un destino de un listener y su estado.
+type upstream struct {
+	addr func() string // ip:puerto; puede cambiar (dispositivo por nombre, líder del grupo) o ser "" si aún no se conoce
+
+	mu      sync.Mutex
+	healthy bool
+	checked time.Time
+	lastErr string
+}
+
+// upstreamPool son los destinos de un listener.
+type upstreamPool struct {
+	members []*upstream
+	balance string
+	check   string
+	next    atomic.Uint32
+	down    atomic.Bool // anunciado como caído a los clientes
+}
+
+// UpstreamHealth es el estado de un destino, para la API.
+type UpstreamHealth struct {
+	Listen    string    `json:"listen"`
+	Upstream  string    `json:"upstream"`
+	Healthy   bool      `json:"healthy"`
+	Checked   time.Time `json:"checked,omitempty"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+func newPool(balance, check string, addrs ...func() string) *upstreamPool {
+	if balance == "" {
+		balance = BalanceFailover
+	}
+	if check == "" {
+		check = CheckTCP
+	}
+	p := &upstreamPool{balance: balance, check: check}
+	for _, a := range addrs {
+		// Hasta la primera comprobación se da por sano.
+		p.members = append(p.members, &upstream{addr: a, healthy: true})
+	}
+	return p
+}
+
+// fixedAddr es un destino que no cambia.
+func fixedAddr(addr string) func() string {
+	return func() string { return addr }
+}
+
+// devicePool son los destinos de un puerto del perfil o de un SRV: el
+// dispositivo y sus réplicas, o lo que diga l.upstream (un grupo Cast).
+func devicePool(l *portListener) *upstreamPool {
+	addrs := []func() string{l.upstreamAddr}
+	if l.upstream != nil {
+		return newPool(DeviceBalance, DeviceCheck, addrs...)
+	}
+	for _, ip := range DeviceReplicas {
+		addrs = append(addrs, fixedAddr(net.JoinHostPort(ip.String(), fmt.Sprint(l.upPort))))
+	}
+	return newPool(DeviceBalance, DeviceCheck, addrs...)
+}
+
+// candidates devuelve los destinos en el orden en que hay que probarlos: los
+// sanos según el reparto y, detrás, los caídos por si se han recuperado.
+func (p *upstreamPool) candidates() []*upstream {
+	var up, down []*upstream
+	for _, u := range p.members {
+		if u.isHealthy() {
+			up = append(up, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	if p.balance == BalanceRoundRobin && len(up) > 1 {
+		n := int(p.next.Add(1)-1) % len(up)
+		up = append(up[n:len(up):len(up)], up[:n]...)
+	}
+	return append(up, down...)
+}
+
+// allDown indica si no queda ningún destino sano.
+func (p *upstreamPool) allDown() bool {
+	for _, u := range p.members {
+		if u.isHealthy() {
+			return false
+		}
+	}
+	return true
+}
+
+func (u *upstream) isHealthy() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.healthy
+}
+
+// setHealth apunta el resultado de una comprobación o conexión y emite un
+// evento si cambia el estado.
+func (u *upstream) setHealth(listen, addr string, err error) {
+	u.mu.Lock()
+	was := u.healthy
+	u.healthy = err == nil
+	u.checked = time.Now()
+	u.lastErr = ""
+	if err != nil {
+		u.lastErr = err.Error()
+	}
+	u.mu.Unlock()
+
+	switch {
+	case was && err != nil:
+		Emit("upstream", "Destino caído", map[string]string{"listen": listen, "upstream": addr, "error": err.Error()})
+	case !was && err == nil:
+		Emit("upstream", "Destino recuperado", map[string]string{"listen": listen, "upstream": addr})
+	}
+}
+
+// checkUpstream comprueba que addr acepte conexiones (y, con CheckTLS, que
+// complete el handshake).
+func checkUpstream(addr, check string, timeout time.Duration) error {
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if check != CheckTLS {
+		return nil
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	// Los dispositivos suelen tener certificados propios: sólo comprobamos
+	// que el TLS responde.
+	return tls.Client(c, &tls.Config{InsecureSkipVerify: true}).Handshake()
+}
+
+// checkHealth comprueba cada HealthInterval los destinos de todos los
+// listeners hasta que se cancele ctx.
+func checkHealth(ctx context.Context) {
+	t := time.NewTicker(HealthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		listeners.Lock()
+		ls := make([]*portListener, 0, len(listeners.m))
+		for _, l := range listeners.m {
+			if l.pool != nil && l.pool.check != CheckNone {
+				ls = append(ls, l)
+			}
+		}
+		listeners.Unlock()
+
+		var wg sync.WaitGroup
+		for _, l := range ls {
+			for _, u := range l.pool.members {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					addr := u.addr()
+					if addr == "" {
+						// Sin dirección no hay nada que comprobar.
+						return
+					}
+					u.setHealth(l.addr, addr, checkUpstream(addr, l.pool.check, l.timeout))
+					l.poolChanged()
+				}()
+			}
+		}
+		wg.Wait()
+	}
+}
+
+// Upstreams devuelve el estado de los destinos de todos los listeners.
+func Upstreams() []UpstreamHealth {
+	listeners.Lock()
+	ls := make([]*portListener, 0, len(listeners.m))
+	for _, l := range listeners.m {
+		if l.pool != nil {
+			ls = append(ls, l)
+		}
+	}
+	listeners.Unlock()
+
+	var out []UpstreamHealth
+	for _, l := range ls {
+		for _, u := range l.pool.members {
+			addr := u.addr() // antes de bloquear u: puede bloquear listeners
+			u.mu.Lock()
+			out = append(out, UpstreamHealth{
+				Listen:    l.addr,
+				Upstream:  addr,
+				Healthy:   u.healthy,
+				Checked:   u.checked,
+				LastError: u.lastErr,
+			})
+			u.mu.Unlock()
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Listen != out[j].Listen {
+			return out[i].Listen < out[j].Listen
+		}
+		return out[i].Upstream < out[j].Upstream
+	})
+	return out
+}
+
+// poolChanged avisa a los clientes si el pool de l acaba de quedarse sin
+// destinos sanos (despedida de sus servicios) o de recuperar alguno (anuncio).
+func (l *portListener) poolChanged() {
+	down := l.pool.allDown()
+	if l.pool.down.Swap(down) == down {
+		return
+	}
+	tcp, ok := l.ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	// Sólo si es el listener de lo que se anuncia (la IP del proxy).
+	ipProxy, _ := proxy()
+	listeners.Lock()
+	serving := findListener(ipProxy, tcp.Port) == l
+	listeners.Unlock()
+	if serving {
+		go announcePort(tcp.Port, down)
+	}
+}
+
+// announcer envía a los clientes los paquetes que genera el proxy por la
+// salud de los destinos; lo fija AnnounceWith.
+var announcer = struct {
+	sync.Mutex
+	send func([]Packet)
+}{}
+
+// AnnounceWith hace que las despedidas de los servicios que se quedan sin
+// destinos sanos, y su anuncio al recuperarse, se envíen con send hacia los
+// clientes, como los paquetes de Mdns en ToClient.
+func AnnounceWith(send func([]Packet)) {
+	announcer.Lock()
+	announcer.send = send
+	announcer.Unlock()
+}
+
+// announcePort despide (down) o vuelve a anunciar las instancias del
+// dispositivo que se anuncian en el puerto port, con los registros que
+// tienen los Querier en caché. El mensaje sigue el mismo camino hacia los
+// clientes que una respuesta del dispositivo (ACL, políticas por cliente,
+// dispositivos virtuales...).
+func announcePort(port int, down bool) {
+	announcer.Lock()
+	send := announcer.send
+	announcer.Unlock()
+	ipDevice, _ := device()
+	if send == nil || ipDevice == nil {
+		return
+	}
+	var cached []dns.RR
+	queriers.Lock()
+	list := append([]*Querier(nil), queriers.list...)
+	queriers.Unlock()
+	for _, q := range list {
+		cached = append(cached, q.Records()...)
+	}
+
+	insts := map[string]bool{}
+	hosts := map[string]bool{}
+	for _, rr := range cached {
+		if srv, ok := rr.(*dns.SRV); ok && int(advertisedPort(srv.Port)) == port {
+			insts[strings.ToLower(srv.Hdr.Name)] = true
+			hosts[strings.ToLower(srv.Target)] = true
+		}
+	}
+	if len(insts) == 0 {
+		return
+	}
+
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Authoritative = true
+	for _, rr := range cached {
+		name := strings.ToLower(rr.Header().Name)
+		ptr, isPtr := rr.(*dns.PTR)
+		switch {
+		case insts[name], isPtr && insts[strings.ToLower(ptr.Ptr)]:
+		case !down && hosts[name]:
+			// Al volver, también las direcciones del host.
+		default:
+			continue
+		}
+		if down {
+			rr.Header().Ttl = 0
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	fmt.Println("--------------------------------------------------")
+	if down {
+		fmt.Printf("Despedida de los servicios del puerto %d (destinos caídos):\n", port)
+	} else {
+		fmt.Printf("Anuncio de los servicios del puerto %d (destino recuperado):\n", port)
+	}
+	send(deliver(msg, &net.UDPAddr{IP: ipDevice, Port: MdnsGroup.Port}, DeviceIface, ToClient))
+}
+
+// portDown indica si el puerto anunciado ip:port lo atiende un listener sin
+// ningún destino sano.
+func portDown(ip net.IP, port int) bool {
+	listeners.Lock()
+	defer listeners.Unlock()
+	l := findListener(ip, port)
+	return l != nil && l.pool != nil && l.pool.allDown()
+}
+
+// hideDownServices quita de la respuesta msg las instancias cuyo puerto
+// (en la IP del proxy, que es donde se anuncian) tiene todos los destinos
+// caídos, para no anunciar a los clientes un servicio que no funciona.
+// Devuelve cuántas quitó.
+func hideDownServices(msg *dns.Msg) int {
+	if !msg.Response {
+		return 0
+	}
+	ipProxy, _ := proxy()
+	down := map[string]bool{}
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range sec {
+			if srv, ok := rr.(*dns.SRV); ok && srv.Hdr.Ttl > 0 && portDown(ipProxy, int(advertisedPort(srv.Port))) {
+				down[strings.ToLower(srv.Hdr.Name)] = true
+			}
+		}
+	}
+	if len(down) == 0 {
+		return 0
+	}
+
+	dropInstances(msg, down)
+	for name := range down {
+		log.Printf("No se anuncia %s: todos sus destinos están caídos", name)
+	}
+	return len(down)
+}
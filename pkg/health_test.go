@@ -0,0 +1,264 @@
+package pkg
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func poolAddrs(us []*upstream) []string {
+	var out []string
+	for _, u := range us {
+		out = append(out, u.addr())
+	}
+	return out
+}
+
+func TestCandidates(t *testing.T) {
+	tests := []struct {
+		name    string
+		balance string
+		down    []int // miembros caídos
+		rounds  [][]string
+	}{
+		{
+			name:    "failover",
+			balance: BalanceFailover,
+			rounds:  [][]string{{"a", "b", "c"}, {"a", "b", "c"}},
+		},
+		{
+			name:    "failover con el primero caído",
+			balance: BalanceFailover,
+			down:    []int{0},
+			rounds:  [][]string{{"b", "c", "a"}, {"b", "c", "a"}},
+		},
+		{
+			name:    "roundrobin",
+			balance: BalanceRoundRobin,
+			rounds:  [][]string{{"a", "b", "c"}, {"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}},
+		},
+		{
+			name:    "roundrobin entre los sanos",
+			balance: BalanceRoundRobin,
+			down:    []int{1},
+			rounds:  [][]string{{"a", "c", "b"}, {"c", "a", "b"}, {"a", "c", "b"}},
+		},
+		{
+			name:    "todos caídos",
+			balance: BalanceRoundRobin,
+			down:    []int{0, 1, 2},
+			rounds:  [][]string{{"a", "b", "c"}, {"a", "b", "c"}},
+		},
+	}
+	for _, tt := range tests {
+		p := newPool(tt.balance, "", fixedAddr("a"), fixedAddr("b"), fixedAddr("c"))
+		for _, i := range tt.down {
+			p.members[i].setHealth("test", p.members[i].addr(), errors.New("caído"))
+		}
+		for i, want := range tt.rounds {
+			if got := poolAddrs(p.candidates()); !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: vuelta %d: candidates = %v, se esperaba %v", tt.name, i, got, want)
+			}
+		}
+		if got, want := p.allDown(), len(tt.down) == len(p.members); got != want {
+			t.Errorf("%s: allDown = %v, se esperaba %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestDropInstances(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{
+		rr(t, "_googlecast._tcp.local. 120 IN PTR TV._googlecast._tcp.local."),
+		rr(t, "_googlecast._tcp.local. 120 IN PTR Altavoz._googlecast._tcp.local."),
+	}
+	msg.Extra = []dns.RR{
+		rr(t, "TV._googlecast._tcp.local. 120 IN SRV 0 0 8009 tv.local."),
+		rr(t, `TV._googlecast._tcp.local. 120 IN TXT "fn=TV"`),
+		rr(t, "Altavoz._googlecast._tcp.local. 120 IN SRV 0 0 8009 altavoz.local."),
+		rr(t, "tv.local. 120 IN A 192.168.2.172"),
+	}
+	dropInstances(msg, map[string]bool{"tv._googlecast._tcp.local.": true})
+
+	var got []string
+	for _, r := range append(msg.Answer, msg.Extra...) {
+		got = append(got, r.Header().Name+" "+dns.TypeToString[r.Header().Rrtype])
+	}
+	want := []string{
+		"_googlecast._tcp.local. PTR",
+		"Altavoz._googlecast._tcp.local. SRV",
+		"tv.local. A",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dropInstances dejó %v, se esperaba %v", got, want)
+	}
+	if ptr := msg.Answer[0].(*dns.PTR); !strings.HasPrefix(ptr.Ptr, "Altavoz.") {
+		t.Errorf("se quedó el PTR a %s", ptr.Ptr)
+	}
+}
+
+// fakeListener es un listener sin socket, para registrar puertos en
+// listeners.
+type fakeListener struct{ addr *net.TCPAddr }
+
+func (l fakeListener) Accept() (net.Conn, error) { return nil, errors.New("cerrado") }
+func (l fakeListener) Close() error              { return nil }
+func (l fakeListener) Addr() net.Addr            { return l.addr }
+
+func TestHideDownServices(t *testing.T) {
+	testAddrs(t)
+	ActiveProfile = Profile{Ports: map[uint16]uint16{8009: 8010}}
+
+	// El puerto 8010 (el 8009 del dispositivo) tiene su único destino caído;
+	// el 8008, uno caído y otro sano.
+	down := newPool("", "", fixedAddr("192.168.2.172:8009"))
+	down.members[0].setHealth("test", "192.168.2.172:8009", errors.New("caído"))
+	half := newPool("", "", fixedAddr("192.168.2.172:8008"), fixedAddr("192.168.2.173:8008"))
+	half.members[0].setHealth("test", "192.168.2.172:8008", errors.New("caído"))
+	// El 8011 lo comparten dos reenvíos: el de la IP del proxy está sano y
+	// el de otra IP (otro dispositivo), caído.
+	other := newPool("", "", fixedAddr("192.168.2.180:8011"))
+	other.members[0].setHealth("test", "192.168.2.180:8011", errors.New("caído"))
+	listeners.Lock()
+	listeners.m["test:8010"] = &portListener{ln: fakeListener{&net.TCPAddr{Port: 8010}}, pool: down}
+	listeners.m["test:8008"] = &portListener{ln: fakeListener{&net.TCPAddr{Port: 8008}}, pool: half}
+	listeners.m["test:a:8011"] = &portListener{ln: fakeListener{&net.TCPAddr{IP: net.ParseIP("10.0.0.6"), Port: 8011}}, pool: other}
+	listeners.m["test:b:8011"] = &portListener{ln: fakeListener{&net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 8011}}, pool: newPool("", "", fixedAddr("192.168.2.172:8011"))}
+	listeners.Unlock()
+	t.Cleanup(func() {
+		listeners.Lock()
+		for _, k := range []string{"test:8010", "test:8008", "test:a:8011", "test:b:8011"} {
+			delete(listeners.m, k)
+		}
+		listeners.Unlock()
+	})
+
+	tests := []struct {
+		name    string
+		query   bool
+		records []string
+		hidden  int
+		left    int
+	}{
+		{
+			name: "puerto caído",
+			records: []string{
+				"_googlecast._tcp.local. 120 IN PTR TV._googlecast._tcp.local.",
+				"TV._googlecast._tcp.local. 120 IN SRV 0 0 8009 tv.local.",
+				`TV._googlecast._tcp.local. 120 IN TXT "fn=TV"`,
+			},
+			hidden: 1,
+		},
+		{
+			name: "queda un destino sano",
+			records: []string{
+				"_googlecast._tcp.local. 120 IN PTR TV._googlecast._tcp.local.",
+				"TV._googlecast._tcp.local. 120 IN SRV 0 0 8008 tv.local.",
+			},
+			left: 2,
+		},
+		{
+			name: "puerto compartido, sano en la IP del proxy",
+			records: []string{
+				"TV._googlecast._tcp.local. 120 IN SRV 0 0 8011 tv.local.",
+			},
+			left: 1,
+		},
+		{
+			name: "puerto sin listener",
+			records: []string{
+				"TV._googlecast._tcp.local. 120 IN SRV 0 0 9000 tv.local.",
+			},
+			left: 1,
+		},
+		{
+			name: "goodbye",
+			records: []string{
+				"TV._googlecast._tcp.local. 0 IN SRV 0 0 8009 tv.local.",
+			},
+			left: 1,
+		},
+		{
+			name:  "pregunta",
+			query: true,
+			records: []string{
+				"TV._googlecast._tcp.local. 120 IN SRV 0 0 8009 tv.local.",
+			},
+			left: 1,
+		},
+	}
+	for _, tt := range tests {
+		msg := new(dns.Msg)
+		msg.Response = !tt.query
+		for _, s := range tt.records {
+			msg.Answer = append(msg.Answer, rr(t, s))
+		}
+		if got := hideDownServices(msg); got != tt.hidden {
+			t.Errorf("%s: hideDownServices = %d, se esperaba %d", tt.name, got, tt.hidden)
+		}
+		if len(msg.Answer) != tt.left {
+			t.Errorf("%s: quedan %d registros, se esperaban %d", tt.name, len(msg.Answer), tt.left)
+		}
+	}
+}
+
+// Las despedidas de un puerto caído siguen el camino de las respuestas del
+// dispositivo: también se despiden las instancias de los dispositivos
+// virtuales.
+func TestAnnouncePortGoodbye(t *testing.T) {
+	testAddrs(t)
+	ActiveProfile = Profile{}
+	virtual := VirtualDevices
+	VirtualDevices = []VirtualDevice{{Name: "Sala", Proxy: net.ParseIP("10.0.0.6").To4()}}
+	t.Cleanup(func() { VirtualDevices = virtual })
+
+	q := &Querier{records: map[string]*cachedRR{}}
+	for _, s := range []string{
+		"_googlecast._tcp.local. 120 IN PTR TV._googlecast._tcp.local.",
+		"TV._googlecast._tcp.local. 120 IN SRV 0 0 8009 tv.local.",
+		`TV._googlecast._tcp.local. 120 IN TXT "fn=TV"`,
+		"tv.local. 120 IN A 192.168.2.172",
+		"Otro._googlecast._tcp.local. 120 IN SRV 0 0 8008 tv.local.",
+	} {
+		r := rr(t, s)
+		q.records[rrKey(r)] = &cachedRR{rr: r, received: time.Now()}
+	}
+	queriers.Lock()
+	saved := queriers.list
+	queriers.list = []*Querier{q}
+	queriers.Unlock()
+
+	var sent []Packet
+	AnnounceWith(func(pkts []Packet) { sent = append(sent, pkts...) })
+	t.Cleanup(func() {
+		AnnounceWith(nil)
+		queriers.Lock()
+		queriers.list = saved
+		queriers.Unlock()
+	})
+
+	announcePort(8009, true)
+	if len(sent) != 1 {
+		t.Fatalf("se enviaron %d paquetes, se esperaba 1", len(sent))
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(sent[0].Data); err != nil {
+		t.Fatal(err)
+	}
+	srvs := map[string]uint32{}
+	for _, r := range append(msg.Answer, msg.Extra...) {
+		if srv, ok := r.(*dns.SRV); ok {
+			srvs[strings.ToLower(srv.Hdr.Name)] = srv.Hdr.Ttl
+		}
+	}
+	want := map[string]uint32{"tv._googlecast._tcp.local.": 0, "sala._googlecast._tcp.local.": 0}
+	if !reflect.DeepEqual(srvs, want) {
+		t.Errorf("SRV despedidos = %v, se esperaba %v", srvs, want)
+	}
+}
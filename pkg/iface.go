@@ -0,0 +1,234 @@
+package pkg
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// MdnsGroup es el grupo multicast IPv4 de mDNS.
+var MdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+var errIfaceDown = errors.New("interfaz sin socket mDNS")
+
+// McastIface mantiene el socket mDNS de una interfaz y lo vuelve a abrir
+// cuando la interfaz se levanta de nuevo o cambia de dirección.
+type McastIface struct {
+	Name string
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	conn  *net.UDPConn
+	index int
+	dirty bool // hay que reabrir el socket (volver a unirse al grupo)
+	kick  chan struct{}
+}
+
+// NewMcastIface prepara el socket para la interfaz name. El socket no se
+// abre hasta llamar a Open.
+func NewMcastIface(name string) *McastIface {
+	m := &McastIface{Name: name, kick: make(chan struct{}, 1)}
+	m.cond = sync.NewCond(&m.mu)
+	go m.reopenLoop()
+	return m
+}
+
+// Open abre (o reabre) el socket y se une al grupo multicast.
+func (m *McastIface) Open() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+	m.dirty = false
+
+	iface, err := net.InterfaceByName(m.Name)
+	if err != nil {
+		m.dirty = true
+		return err
+	}
+	m.index = iface.Index
+
+	conn, err := net.ListenMulticastUDP("udp4", iface, MdnsGroup)
+	if err != nil {
+		m.dirty = true
+		return err
+	}
+	// Todos los sockets escuchan en 224.0.0.251:5353; sin esto cada uno
+	// recibe también lo que llega por las interfaces de los demás.
+	if err := multicastOnlyJoined(conn); err != nil {
+		conn.Close()
+		m.dirty = true
+		return err
+	}
+	m.conn = conn
+	m.cond.Broadcast()
+	return nil
+}
+
+// multicastOnlyJoined desactiva IP_MULTICAST_ALL en conn, para que sólo
+// reciba los grupos a los que se unió en su interfaz.
+func multicastOnlyJoined(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_ALL, 0)
+	})
+	if err == nil {
+		err = serr
+	}
+	return err
+}
+
+// shut cierra el socket actual; Serve queda esperando a que se reabra.
+func (m *McastIface) shut() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn != nil {
+		m.conn.Close()
+		m.conn = nil
+	}
+}
+
+// Close cierra el socket definitivamente.
+func (m *McastIface) Close() {
+	m.shut()
+}
+
+func (m *McastIface) signal() {
+	select {
+	case m.kick <- struct{}{}:
+	default:
+	}
+}
+
+// reopenLoop reabre el socket cuando un evento lo pide y, por si se pierde
+// algún evento de netlink, lo reintenta periódicamente mientras esté caído.
+func (m *McastIface) reopenLoop() {
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.kick:
+		case <-t.C:
+		}
+
+		m.mu.Lock()
+		need := m.dirty
+		m.mu.Unlock()
+		if !need {
+			continue
+		}
+
+		if err := m.Open(); err != nil {
+			log.Printf("No se pudo reabrir mDNS en %s: %v", m.Name, err)
+			continue
+		}
+		log.Printf("Socket mDNS reabierto en %s", m.Name)
+	}
+}
+
+// HandleLink reacciona a los cambios de estado de la interfaz.
+func (m *McastIface) HandleLink(ev LinkEvent) {
+	if ev.Name != m.Name {
+		return
+	}
+	m.mu.Lock()
+	m.index = ev.Index
+	if !ev.Up {
+		if m.conn != nil {
+			log.Printf("Interfaz %s caída, cerrando socket mDNS", m.Name)
+			m.conn.Close()
+			m.conn = nil
+		}
+		m.dirty = false
+		m.mu.Unlock()
+		return
+	}
+	if m.conn == nil {
+		m.dirty = true
+	}
+	m.mu.Unlock()
+	m.signal()
+}
+
+// HandleAddr vuelve a unirse al grupo cuando cambia una dirección IPv4 de
+// la interfaz, ya que la pertenencia va ligada a ella. Las IPv6 y los alias
+// que añade el propio proxy no afectan al socket.
+func (m *McastIface) HandleAddr(ev AddrEvent) {
+	if ev.Family != unix.AF_INET || isAlias(ev.IP) {
+		return
+	}
+	m.mu.Lock()
+	if ev.Index != m.index {
+		m.mu.Unlock()
+		return
+	}
+	m.dirty = true
+	m.mu.Unlock()
+	m.signal()
+}
+
+// Index devuelve el índice de la interfaz.
+func (m *McastIface) Index() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.index
+}
+
+// wait bloquea hasta que haya un socket abierto.
+func (m *McastIface) wait() *net.UDPConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for m.conn == nil {
+		m.cond.Wait()
+	}
+	return m.conn
+}
+
+// Serve lee paquetes de la interfaz y llama a handle con cada uno. Si la
+// interfaz se cae, espera a que vuelva en lugar de reintentar en bucle.
+func (m *McastIface) Serve(handle func(b []byte, src *net.UDPAddr)) {
+	for {
+		conn := m.wait()
+
+		buf := make([]byte, 4000) // Tamaño estándar para DNS sobre UDP.
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			m.mu.Lock()
+			if m.conn == conn {
+				// El socket falló sin que lo cerrásemos nosotros.
+				log.Printf("Error al leer del socket UDP en %s: %v", m.Name, err)
+				m.conn.Close()
+				m.conn = nil
+				m.dirty = true
+			}
+			m.mu.Unlock()
+			m.signal()
+			continue
+		}
+
+		handle(buf[:n], src)
+	}
+}
+
+// WriteTo envía b por la interfaz.
+func (m *McastIface) WriteTo(b []byte, addr *net.UDPAddr) error {
+	m.mu.Lock()
+	conn := m.conn
+	m.mu.Unlock()
+	if conn == nil {
+		return errIfaceDown
+	}
+	_, err := conn.WriteToUDP(b, addr)
+	return err
+}
@@ -0,0 +1,334 @@
+package pkg
+
+import (
+	"encoding/csv"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Host es un equipo visto por mDNS, con las direcciones que anuncia.
+type Host struct {
+	Name      string           `json:"name"`
+	Addrs     map[string]*Seen `json:"addrs"`
+	Iface     string           `json:"iface"`
+	FirstSeen time.Time        `json:"first_seen"`
+	LastSeen  time.Time        `json:"last_seen"`
+	Expires   time.Time        `json:"expires"`
+}
+
+// Service es una instancia de servicio anunciada por mDNS.
+type Service struct {
+	Instance  string    `json:"instance"`
+	Type      string    `json:"type"`
+	Host      string    `json:"host"`
+	Port      uint16    `json:"port"`
+	Txt       []string  `json:"txt"`
+	Source    string    `json:"source"` // IP que lo anunció
+	Iface     string    `json:"iface"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Seen guarda cuándo se vio algo por primera y última vez.
+type Seen struct {
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Inventory es un inventario pasivo de todos los hosts y servicios que
+// aparecen en el tráfico mDNS de ambas interfaces. Cada entrada caduca con
+// el TTL de sus registros (o InventoryIdle si sólo se vio su IP).
+type Inventory struct {
+	mu       sync.Mutex
+	hosts    map[string]*Host    // nombre (o IP si no anunció nombre)
+	services map[string]*Service // instancia
+	owners   map[string]string   // IP -> host con nombre que la anuncia
+	swept    time.Time
+}
+
+// InventoryIdle es cuánto se recuerda un equipo del que sólo se ha visto la
+// IP de origen.
+var InventoryIdle = 75 * time.Minute
+
+// maxInventory es el máximo de hosts y de servicios del inventario.
+const maxInventory = 4096
+
+// Assets es el inventario que alimenta Mdns.
+var Assets = &Inventory{
+	hosts:    map[string]*Host{},
+	services: map[string]*Service{},
+	owners:   map[string]string{},
+}
+
+func init() {
+	OnPacket(Assets.observe)
+}
+
+func (inv *Inventory) observe(msg *dns.Msg, src *net.UDPAddr, iface string) {
+	now := time.Now()
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if now.Sub(inv.swept) >= 10*time.Second {
+		inv.expire(now)
+	}
+
+	if src != nil {
+		if h := inv.host(src.IP.String(), iface, now); h != nil {
+			extend(&h.Expires, now.Add(InventoryIdle))
+		}
+	}
+	if !msg.Response {
+		return
+	}
+
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range sec {
+			name := strings.ToLower(rr.Header().Name)
+			ttl := time.Duration(rr.Header().Ttl) * time.Second
+			if ttl == 0 {
+				inv.goodbye(rr, name)
+				continue
+			}
+			switch r := rr.(type) {
+			case *dns.A:
+				inv.addr(inv.host(name, iface, now), r.A.String(), now, ttl)
+			case *dns.AAAA:
+				inv.addr(inv.host(name, iface, now), r.AAAA.String(), now, ttl)
+			case *dns.PTR:
+				if strings.HasSuffix(name, ".arpa.") || strings.HasPrefix(name, "_services.") {
+					continue
+				}
+				if s := inv.service(strings.ToLower(r.Ptr), src, iface, now, ttl); s != nil {
+					s.Type = name
+				}
+			case *dns.SRV:
+				if s := inv.service(name, src, iface, now, ttl); s != nil {
+					s.Host = strings.ToLower(r.Target)
+					s.Port = r.Port
+				}
+			case *dns.TXT:
+				if s := inv.service(name, src, iface, now, ttl); s != nil {
+					s.Txt = r.Txt
+				}
+			}
+		}
+	}
+}
+
+// goodbye olvida lo que retira un registro con TTL 0.
+func (inv *Inventory) goodbye(rr dns.RR, name string) {
+	switch r := rr.(type) {
+	case *dns.A:
+		inv.dropAddr(name, r.A.String())
+	case *dns.AAAA:
+		inv.dropAddr(name, r.AAAA.String())
+	case *dns.PTR:
+		delete(inv.services, strings.ToLower(r.Ptr))
+	case *dns.SRV:
+		delete(inv.services, name)
+	}
+}
+
+func (inv *Inventory) dropAddr(name, ip string) {
+	if h, ok := inv.hosts[name]; ok {
+		delete(h.Addrs, ip)
+	}
+	if inv.owners[ip] == name {
+		delete(inv.owners, ip)
+	}
+}
+
+// expire quita lo que ha caducado. Se llama con inv bloqueado.
+func (inv *Inventory) expire(now time.Time) {
+	inv.swept = now
+	for key, h := range inv.hosts {
+		if now.After(h.Expires) {
+			delete(inv.hosts, key)
+			for ip := range h.Addrs {
+				if inv.owners[ip] == key {
+					delete(inv.owners, ip)
+				}
+			}
+		}
+	}
+	for key, s := range inv.services {
+		if now.After(s.Expires) {
+			delete(inv.services, key)
+		}
+	}
+}
+
+// extend alarga t hasta until si es más tarde.
+func extend(t *time.Time, until time.Time) {
+	if until.After(*t) {
+		*t = until
+	}
+}
+
+// host devuelve (creándolo si hace falta) el host con ese nombre o IP. Una
+// IP que ya anuncia un host con nombre es ese host. Devuelve nil si el
+// inventario está lleno.
+func (inv *Inventory) host(key, iface string, now time.Time) *Host {
+	if owner, ok := inv.owners[key]; ok {
+		if h, ok := inv.hosts[owner]; ok {
+			h.LastSeen = now
+			return h
+		}
+	}
+	h, ok := inv.hosts[key]
+	if !ok {
+		if len(inv.hosts) >= maxInventory {
+			return nil
+		}
+		h = &Host{Addrs: map[string]*Seen{}, Iface: iface, FirstSeen: now}
+		if net.ParseIP(key) == nil {
+			h.Name = key
+		} else {
+			h.Addrs[key] = &Seen{FirstSeen: now, LastSeen: now}
+		}
+		inv.hosts[key] = h
+	}
+	h.LastSeen = now
+	return h
+}
+
+// addr apunta que h anuncia ip durante ttl. Si sólo conocíamos ip como host
+// anónimo, pasa a estar bajo el nombre de h.
+func (inv *Inventory) addr(h *Host, ip string, now time.Time, ttl time.Duration) {
+	if h == nil {
+		return
+	}
+	extend(&h.Expires, now.Add(ttl))
+	s, ok := h.Addrs[ip]
+	if !ok {
+		s = &Seen{FirstSeen: now}
+		h.Addrs[ip] = s
+	}
+	s.LastSeen = now
+	if h.Name == "" {
+		return
+	}
+	inv.owners[ip] = h.Name
+	if anon, ok := inv.hosts[ip]; ok && anon.Name == "" {
+		if anon.FirstSeen.Before(h.FirstSeen) {
+			h.FirstSeen = anon.FirstSeen
+		}
+		if anon.FirstSeen.Before(s.FirstSeen) {
+			s.FirstSeen = anon.FirstSeen
+		}
+		delete(inv.hosts, ip)
+	}
+}
+
+func (inv *Inventory) service(instance string, src *net.UDPAddr, iface string, now time.Time, ttl time.Duration) *Service {
+	s, ok := inv.services[instance]
+	if !ok {
+		if len(inv.services) >= maxInventory {
+			return nil
+		}
+		s = &Service{Instance: instance, FirstSeen: now}
+		// Mientras no veamos el PTR, el tipo es lo que sigue a la instancia.
+		if i := strings.Index(instance, "._"); i >= 0 {
+			s.Type = instance[i+1:]
+		}
+		inv.services[instance] = s
+	}
+	if src != nil {
+		s.Source = src.IP.String()
+	}
+	s.Iface = iface
+	s.LastSeen = now
+	extend(&s.Expires, now.Add(ttl))
+	return s
+}
+
+// Hosts devuelve una copia de los hosts ordenada por nombre.
+func (inv *Inventory) Hosts() []Host {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	out := make([]Host, 0, len(inv.hosts))
+	for _, h := range inv.hosts {
+		c := *h
+		c.Addrs = make(map[string]*Seen, len(h.Addrs))
+		for ip, s := range h.Addrs {
+			v := *s
+			c.Addrs[ip] = &v
+		}
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return hostKey(out[i]) < hostKey(out[j]) })
+	return out
+}
+
+// Services devuelve una copia de los servicios ordenada por instancia.
+func (inv *Inventory) Services() []Service {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	out := make([]Service, 0, len(inv.services))
+	for _, s := range inv.services {
+		c := *s
+		c.Txt = append([]string(nil), s.Txt...)
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Instance < out[j].Instance })
+	return out
+}
+
+func hostKey(h Host) string {
+	if h.Name != "" {
+		return h.Name
+	}
+	for ip := range h.Addrs {
+		return ip
+	}
+	return ""
+}
+
+// WriteHostsCSV exporta los hosts en CSV, una fila por dirección.
+func (inv *Inventory) WriteHostsCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "addr", "iface", "first_seen", "last_seen"})
+	for _, h := range inv.Hosts() {
+		if len(h.Addrs) == 0 {
+			cw.Write([]string{h.Name, "", h.Iface, csvTime(h.FirstSeen), csvTime(h.LastSeen)})
+		}
+		ips := make([]string, 0, len(h.Addrs))
+		for ip := range h.Addrs {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		for _, ip := range ips {
+			s := h.Addrs[ip]
+			cw.Write([]string{h.Name, ip, h.Iface, csvTime(s.FirstSeen), csvTime(s.LastSeen)})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// WriteServicesCSV exporta los servicios en CSV.
+func (inv *Inventory) WriteServicesCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"instance", "type", "host", "port", "txt", "source", "iface", "first_seen", "last_seen"})
+	for _, s := range inv.Services() {
+		cw.Write([]string{
+			s.Instance, s.Type, s.Host, strconv.Itoa(int(s.Port)), strings.Join(s.Txt, ";"),
+			s.Source, s.Iface, csvTime(s.FirstSeen), csvTime(s.LastSeen),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func csvTime(t time.Time) string { return t.UTC().Format(time.RFC3339) }
@@ -4,6 +4,7 @@ package pkg
 import (
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/coreos/go-iptables/iptables"
 )
@@ -67,3 +68,65 @@ func (m *Manager) DelMasquerade(outIf string) error {
 	}
 	return m.ipt.Delete("nat", "POSTROUTING", rule...)
 }
+
+// transparentRule es la regla que desvía al proxy transparente lo que entra
+// por iface hacia el puerto TCP port:
+// nat/PREROUTING:    -i IFACE -p tcp --dport PORT -j REDIRECT --to-ports TOPORT
+// mangle/PREROUTING: -i IFACE -p tcp --dport PORT -j TPROXY --on-port TOPORT --tproxy-mark 0x1/0x1
+func transparentRule(mode, iface string, port, toPort int) (table string, rule []string, err error) {
+	rule = []string{
+		"-i", iface,
+		"-p", "tcp", "--dport", strconv.Itoa(port),
+		"-m", "comment", "--comment", "transparent-tcp",
+	}
+	switch mode {
+	case TransparentRedirect:
+		return "nat", append(rule, "-j", "REDIRECT", "--to-ports", strconv.Itoa(toPort)), nil
+	case TransparentTProxy:
+		mark := fmt.Sprintf("%#x/%#x", tproxyMark, tproxyMark)
+		return "mangle", append(rule, "-j", "TPROXY", "--on-port", strconv.Itoa(toPort), "--tproxy-mark", mark), nil
+	}
+	return "", nil, fmt.Errorf("modo transparente no válido: %q", mode)
+}
+
+// AddTransparent desvía las conexiones TCP que entran por iface al puerto
+// port hacia el proxy transparente en toPort. Con TPROXY hace falta además
+// AddLocalRouting.
+func (m *Manager) AddTransparent(mode, iface string, port, toPort int) error {
+	table, rule, err := transparentRule(mode, iface, port, toPort)
+	if err != nil {
+		return err
+	}
+	return m.ipt.AppendUnique(table, "PREROUTING", rule...)
+}
+
+// DelTransparent borra exactamente la misma regla creada por AddTransparent.
+func (m *Manager) DelTransparent(mode, iface string, port, toPort int) error {
+	table, rule, err := transparentRule(mode, iface, port, toPort)
+	if err != nil {
+		return err
+	}
+	return m.ipt.Delete(table, "PREROUTING", rule...)
+}
+
+// sourceMarkRule marca las respuestas que llegan por iface a conexiones
+// salientes con la IP del cliente, para que AddLocalRouting las entregue:
+// mangle/PREROUTING: -i IFACE -p tcp -m socket --transparent -j MARK --set-xmark 0x1/0x1
+func sourceMarkRule(iface string) []string {
+	return []string{
+		"-i", iface,
+		"-p", "tcp", "-m", "socket", "--transparent",
+		"-m", "comment", "--comment", "transparent-return",
+		"-j", "MARK", "--set-xmark", fmt.Sprintf("%#x/%#x", tproxyMark, tproxyMark),
+	}
+}
+
+// AddSourceMark añade la regla de sourceMarkRule (ver KeepClientIP).
+func (m *Manager) AddSourceMark(iface string) error {
+	return m.ipt.AppendUnique("mangle", "PREROUTING", sourceMarkRule(iface)...)
+}
+
+// DelSourceMark borra exactamente la misma regla creada por AddSourceMark.
+func (m *Manager) DelSourceMark(iface string) error {
+	return m.ipt.Delete("mangle", "PREROUTING", sourceMarkRule(iface)...)
+}
@@ -0,0 +1,184 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Límites de las conexiones de Redirect; 0 es sin límite.
+var (
+	MaxConns       int           // conexiones abiertas a la vez en total
+	MaxConnsPerIP  int           // conexiones abiertas a la vez por IP de origen
+	AcceptRate     float64       // conexiones nuevas por segundo
+	AcceptBurst    = 20          // ráfaga permitida por encima de AcceptRate
+	IdleTimeout    time.Duration // sin tráfico en ningún sentido
+	MaxSessionTime time.Duration // duración máxima de una sesión
+)
+
+// KeepAlive son los keepalive TCP de las dos patas de cada sesión.
+var KeepAlive = net.KeepAliveConfig{Enable: true, Idle: 30 * time.Second, Interval: 10 * time.Second, Count: 3}
+
+var conns = struct {
+	sync.Mutex
+	total int
+	perIP map[string]int
+
+	// Cubo de fichas de AcceptRate.
+	tokens float64
+	last   time.Time
+}{perIP: map[string]int{}}
+
+// admit decide si se acepta la conexión c. Si se acepta, hay que llamar a
+// release cuando termine; si no, reason dice por qué.
+func admit(c net.Conn) (release func(), reason string) {
+	ip := c.RemoteAddr().String()
+	if rip := remoteIP(c); rip != nil {
+		ip = rip.String()
+	}
+
+	conns.Lock()
+	defer conns.Unlock()
+
+	if AcceptRate > 0 {
+		now := time.Now()
+		if conns.last.IsZero() {
+			conns.tokens = float64(AcceptBurst)
+		} else {
+			conns.tokens += now.Sub(conns.last).Seconds() * AcceptRate
+		}
+		conns.tokens = min(conns.tokens, float64(max(AcceptBurst, 1)))
+		conns.last = now
+		if conns.tokens < 1 {
+			return nil, fmt.Sprintf("más de %g conexiones por segundo", AcceptRate)
+		}
+		conns.tokens--
+	}
+	if MaxConns > 0 && conns.total >= MaxConns {
+		return nil, fmt.Sprintf("límite de %d conexiones", MaxConns)
+	}
+	if MaxConnsPerIP > 0 && conns.perIP[ip] >= MaxConnsPerIP {
+		return nil, fmt.Sprintf("límite de %d conexiones desde %s", MaxConnsPerIP, ip)
+	}
+
+	conns.total++
+	conns.perIP[ip]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			conns.Lock()
+			defer conns.Unlock()
+			conns.total--
+			if conns.perIP[ip]--; conns.perIP[ip] <= 0 {
+				delete(conns.perIP, ip)
+			}
+		})
+	}, ""
+}
+
+// remoteIP es la IP del otro extremo de c, o nil.
+func remoteIP(c net.Conn) net.IP {
+	if tcp, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
+
+// reportReject registra una conexión (o sesión UDP) rechazada, como mucho
+// una vez por segundo por motivo para que una avalancha no llene el log. Las
+// que se callan se resumen un segundo después, aunque no lleguen más.
+func reportReject(from net.Addr, listen, reason string) {
+	rejects.Lock()
+	defer rejects.Unlock()
+	now := time.Now()
+	if now.Sub(rejects.last[reason]) < time.Second {
+		if rejects.dropped[reason]++; rejects.dropped[reason] == 1 {
+			rejects.listen[reason] = listen
+			time.AfterFunc(time.Second-now.Sub(rejects.last[reason]), func() { flushRejects(reason) })
+		}
+		return
+	}
+	if len(rejects.last) > 1000 {
+		// Los motivos llevan la IP: que no crezca sin fin.
+		for k, t := range rejects.last {
+			if now.Sub(t) >= time.Second && rejects.dropped[k] == 0 {
+				delete(rejects.last, k)
+			}
+		}
+	}
+	rejects.last[reason] = now
+	log.Printf("Rechazada la conexión de %s en %s: %s", from, listen, reason)
+}
+
+// flushRejects registra cuántas conexiones se rechazaron sin decirlo por
+// reason.
+func flushRejects(reason string) {
+	rejects.Lock()
+	defer rejects.Unlock()
+	if n := rejects.dropped[reason]; n > 0 {
+		log.Printf("Rechazadas otras %d conexiones en %s: %s", n, rejects.listen[reason], reason)
+		rejects.last[reason] = time.Now()
+	}
+	delete(rejects.dropped, reason)
+	delete(rejects.listen, reason)
+}
+
+var rejects = struct {
+	sync.Mutex
+	last    map[string]time.Time
+	dropped map[string]int
+	listen  map[string]string // dónde se rechazó la primera que se calló
+}{last: map[string]time.Time{}, dropped: map[string]int{}, listen: map[string]string{}}
+
+// activityReader apunta en last la hora de cada lectura con datos.
+type activityReader struct {
+	r    io.Reader
+	last *atomic.Int64 // unix nano
+}
+
+func (a activityReader) Read(b []byte) (int, error) {
+	n, err := a.r.Read(b)
+	if n > 0 {
+		a.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// watchTimeouts cierra la sesión s si pasa IdleTimeout sin tráfico o
+// MaxSessionTime desde que empezó. Termina al cerrar done.
+func watchTimeouts(s *tcpSession, last *atomic.Int64, done <-chan struct{}) {
+	if IdleTimeout <= 0 && MaxSessionTime <= 0 {
+		return
+	}
+	var deadline <-chan time.Time
+	if MaxSessionTime > 0 {
+		t := time.NewTimer(MaxSessionTime)
+		defer t.Stop()
+		deadline = t.C
+	}
+	var tick <-chan time.Time
+	if IdleTimeout > 0 {
+		t := time.NewTicker(min(IdleTimeout/4+time.Millisecond, time.Second))
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-deadline:
+			s.kill(fmt.Sprintf("duración máxima (%s)", MaxSessionTime))
+		case now := <-tick:
+			if now.Sub(time.Unix(0, last.Load())) < IdleTimeout {
+				continue
+			}
+			s.kill(fmt.Sprintf("inactividad (%s)", IdleTimeout))
+		}
+		return
+	}
+}
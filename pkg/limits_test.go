@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// addrConn es una conexión de la que sólo se usa RemoteAddr.
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func TestAdmit(t *testing.T) {
+	maxConns, perIP, rate, burst := MaxConns, MaxConnsPerIP, AcceptRate, AcceptBurst
+	t.Cleanup(func() {
+		MaxConns, MaxConnsPerIP, AcceptRate, AcceptBurst = maxConns, perIP, rate, burst
+	})
+
+	// Cada paso conecta desde una IP (o, si release >= 0, cierra la
+	// conexión aceptada en ese paso).
+	type step struct {
+		ip      string
+		release int
+		ok      bool
+	}
+	conn := func(ip string, ok bool) step { return step{ip: ip, release: -1, ok: ok} }
+	release := func(i int) step { return step{release: i} }
+
+	tests := []struct {
+		name     string
+		maxConns int
+		perIP    int
+		rate     float64
+		burst    int
+		steps    []step
+	}{
+		{
+			name:  "sin límites",
+			steps: []step{conn("10.0.0.1", true), conn("10.0.0.1", true), conn("10.0.0.2", true)},
+		},
+		{
+			name:     "total",
+			maxConns: 2,
+			steps: []step{
+				conn("10.0.0.1", true), conn("10.0.0.2", true), conn("10.0.0.3", false),
+				release(0), conn("10.0.0.3", true),
+			},
+		},
+		{
+			name:  "por IP",
+			perIP: 1,
+			steps: []step{
+				conn("10.0.0.1", true), conn("10.0.0.1", false), conn("10.0.0.2", true),
+				release(0), conn("10.0.0.1", true),
+			},
+		},
+		{
+			name:  "release dos veces cuenta una",
+			perIP: 1,
+			steps: []step{
+				conn("10.0.0.1", true), release(0), release(0), conn("10.0.0.1", true), conn("10.0.0.1", false),
+			},
+		},
+		{
+			name:  "ráfaga",
+			rate:  0.001,
+			burst: 2,
+			steps: []step{conn("10.0.0.1", true), conn("10.0.0.2", true), conn("10.0.0.3", false)},
+		},
+	}
+	for _, tt := range tests {
+		MaxConns, MaxConnsPerIP, AcceptRate, AcceptBurst = tt.maxConns, tt.perIP, tt.rate, tt.burst
+		conns.Lock()
+		conns.total, conns.perIP, conns.tokens, conns.last = 0, map[string]int{}, 0, time.Time{}
+		conns.Unlock()
+
+		releases := make([]func(), len(tt.steps))
+		for i, s := range tt.steps {
+			if s.release >= 0 {
+				releases[s.release]()
+				continue
+			}
+			c := addrConn{remote: &net.TCPAddr{IP: net.ParseIP(s.ip), Port: 40000 + i}}
+			rel, reason := admit(c)
+			if (rel != nil) != s.ok {
+				t.Errorf("%s: paso %d (%s): admitida = %v (%q), se esperaba %v", tt.name, i, s.ip, rel != nil, reason, s.ok)
+			}
+			if rel == nil && reason == "" {
+				t.Errorf("%s: paso %d: rechazada sin motivo", tt.name, i)
+			}
+			releases[i] = rel
+		}
+		for i, s := range tt.steps {
+			if releases[i] != nil && s.release < 0 {
+				releases[i]()
+			}
+		}
+		conns.Lock()
+		if conns.total != 0 || len(conns.perIP) != 0 {
+			t.Errorf("%s: tras cerrar todo quedan %d conexiones (%v)", tt.name, conns.total, conns.perIP)
+		}
+		conns.Unlock()
+	}
+}
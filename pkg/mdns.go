@@ -3,6 +3,8 @@ package pkg
 import (
 	"fmt"
 	"log"
+	"net"
+	"sync"
 
 	"github.com/fatih/color"
 	"github.com/miekg/dns"
@@ -14,9 +16,31 @@ var yellow = color.New(color.FgYellow).SprintFunc()
 var cyan = color.New(color.FgCyan).SprintFunc()
 var blue = color.New(color.FgBlue).SprintFunc()
 
-func Mdns(b []byte) []byte {
+var (
+	observersMu sync.RWMutex
+	observers   []func(msg *dns.Msg, src *net.UDPAddr, iface string)
+)
+
+// OnPacket registra fn para que vea cada mensaje mDNS recibido, antes de
+// reescribirlo. fn no debe modificar msg.
+func OnPacket(fn func(msg *dns.Msg, src *net.UDPAddr, iface string)) {
+	observersMu.Lock()
+	defer observersMu.Unlock()
+	observers = append(observers, fn)
+}
+
+// Packet es un paquete mDNS a enviar.
+type Packet struct {
+	Data  []byte
+	To    *net.UDPAddr // nil: al grupo mDNS
+	Iface string       // "": por la interfaz del otro lado (la de destino de dir)
+}
+
+// Mdns reescribe el paquete b recibido de src por la interfaz iface según
+// la política de la dirección dir y devuelve los paquetes a enviar.
+func Mdns(b []byte, src *net.UDPAddr, iface string, dir Direction) []Packet {
 	fmt.Println("--------------------------------------------------")
-	fmt.Printf("Paquete DNS (tamaño %d bytes):\n", len(b))
+	fmt.Printf("Paquete DNS (tamaño %d bytes, %s):\n", len(b), dir)
 
 	msg := new(dns.Msg)
 	err := msg.Unpack(b)
@@ -27,180 +51,91 @@ func Mdns(b []byte) []byte {
 		return nil
 	}
 
-	// Imprime la sección de Preguntas (si existe)
-	if len(msg.Question) > 0 {
-		fmt.Println("--- Preguntas ---")
-		for i, q := range msg.Question {
-			change := false
-
-			// Solo nos interesa modificar las consultas de tipo PTR (búsqueda inversa de IP).
-			// Si la pregunta es por el nombre asociado a ipDevice...
-			if q.Qtype == dns.TypePTR && q.Name == PtrDevice {
-				// ...la cambiamos para que pregunte por el nombre asociado a ipProxy.
-				msg.Question[i] = dns.Question{
-					Name:   PtrProxy,
-					Qtype:  q.Qtype,
-					Qclass: q.Qclass,
-				}
-				change = true
-			}
+	// Registros del dispositivo anunciados por otro equipo. Se comprueba
+	// antes que nada para que no lleguen a los que aprenden del mensaje.
+	trusted, n := checkSpoof(msg, src, iface)
+	if n > 0 {
+		fmt.Printf("%s\n", red(fmt.Sprintf("Descartados %d registros suplantados de %s", n, src.IP)))
+	}
 
-			// NO modificamos las preguntas de tipo A, ya que esas preguntan por un nombre, no una IP.
+	// Si el dispositivo se busca por nombre, esta respuesta puede traer su IP.
+	byName.observe(trusted)
 
-			if change {
-				fmt.Printf("	-%s\n", red(q.String()))
-				fmt.Printf("	+%s\n", blue(msg.Question[i].String()))
-			} else {
-				fmt.Printf("	%s\n", q.String())
-			}
-		}
+	observersMu.RLock()
+	for _, fn := range observers {
+		fn(trusted, src, iface)
 	}
+	observersMu.RUnlock()
 
-	// Imprime la sección de Respuestas (si existe)
-	if len(msg.Answer) > 0 {
-		fmt.Println("--- Respuestas ---")
-		for i, a := range msg.Answer {
-			change := false
-			// Address
-			if a.Header().Rrtype == dns.TypeA {
-				ip := a.(*dns.A).A.To4()
-				if ip.Equal(IpDevice) {
-					msg.Answer[i] = &dns.A{
-						Hdr: dns.RR_Header{
-							Name:   a.Header().Name,
-							Rrtype: a.Header().Rrtype,
-							Class:  a.Header().Class,
-							Ttl:    a.Header().Ttl,
-						},
-						A: IpProxy,
-					}
-					change = true
-				}
-			}
+	if n > 0 && len(msg.Answer)+len(msg.Ns)+len(msg.Extra) == 0 {
+		return nil
+	}
 
-			//Tipo PTR
-			if a.Header().Rrtype == dns.TypePTR {
-				ptr := a.(*dns.PTR)
-				if PtrDevice == ptr.Hdr.Name {
-					msg.Answer[i] = &dns.PTR{
-						Hdr: dns.RR_Header{
-							Name:   PtrProxy,
-							Rrtype: a.Header().Rrtype,
-							Class:  a.Header().Class,
-							Ttl:    a.Header().Ttl,
-						},
-						Ptr: ptr.Ptr,
-					}
-					change = true
-				}
+	// Preguntas por el nombre de host del dispositivo: contestamos nosotros.
+	var out []Packet
+	if dir == ToDevice {
+		out = respond(msg, src, iface)
+	}
 
-			}
-			if change {
-				fmt.Printf("	-%s\n", red(a.String()))
-				fmt.Printf("	+%s\n", blue(msg.Answer[i].String()))
-			} else {
-				fmt.Printf("	%s\n", a.String())
-			}
+	return append(out, deliver(msg, src, iface, dir)...)
+}
 
+// deliver prepara msg, que viene de src por iface, para el otro lado según
+// dir: servicios caídos, dispositivos virtuales, grupos, ACL y políticas por
+// cliente. Devuelve los paquetes a enviar.
+func deliver(msg *dns.Msg, src *net.UDPAddr, iface string, dir Direction) []Packet {
+	var out []Packet
+
+	// Dispositivos virtuales: copias de las respuestas del físico y, en las
+	// preguntas, sus nombres traducidos a los del físico.
+	switch dir {
+	case ToClient:
+		// Servicios sin ningún destino sano: no se anuncian.
+		if hideDownServices(msg) > 0 && len(msg.Answer)+len(msg.Ns)+len(msg.Extra) == 0 {
+			return out
 		}
+		fanOut(msg, src)
+		// Grupos Cast: sus registros pasan a apuntar al proxy.
+		rewriteGroups(msg)
+	case ToDevice:
+		unvirtualize(msg)
 	}
 
-	// Imprime la sección de Autoridad (si existe)
-	if len(msg.Ns) > 0 {
-		fmt.Println("--- Autoridad ---")
-		for i, ns := range msg.Ns {
-			change := false
-			// Address
-			if ns.Header().Rrtype == dns.TypeA {
-				ip := ns.(*dns.A).A.To4()
-				if ip.Equal(IpDevice) {
-					msg.Ns[i] = &dns.A{
-						Hdr: dns.RR_Header{
-							Name:   ns.Header().Name,
-							Rrtype: ns.Header().Rrtype,
-							Class:  ns.Header().Class,
-							Ttl:    ns.Header().Ttl,
-						},
-						A: IpProxy,
-					}
-					change = true
-				}
-			}
-
-			//Tipo PTR
-			if ns.Header().Rrtype == dns.TypePTR {
-				ptr := ns.(*dns.PTR)
-				if PtrDevice == ptr.Hdr.Name {
-					msg.Ns[i] = &dns.PTR{
-						Hdr: dns.RR_Header{
-							Name:   PtrProxy,
-							Rrtype: ns.Header().Rrtype,
-							Class:  ns.Header().Class,
-							Ttl:    ns.Header().Ttl,
-						},
-						Ptr: ptr.Ptr,
-					}
-					change = true
-				}
-			}
-
-			if change {
-				fmt.Printf("	-%s\n", red(ns.String()))
-				fmt.Printf("	+%s\n", blue(msg.Ns[i].String()))
-			} else {
-				fmt.Printf("	%s\n", ns.String())
+	// Servicios con ACL: sólo a los clientes que pueden usarlos.
+	if dir == ToClient {
+		if acl := restrictServices(msg); len(acl) > 0 {
+			out = append(out, acl...)
+			if len(msg.Answer)+len(msg.Ns)+len(msg.Extra) == 0 {
+				return out
 			}
 		}
 	}
 
-	// Imprime la sección Adicional (si existe)
-	if len(msg.Extra) > 0 {
-		fmt.Println("--- Registros Adicionales ---")
-		for i, e := range msg.Extra {
-			change := false
-			// Address
-			if e.Header().Rrtype == dns.TypeA {
-				ip := e.(*dns.A).A.To4()
-				if ip.Equal(IpDevice) {
-					msg.Extra[i] = &dns.A{
-						Hdr: dns.RR_Header{
-							Name:   e.Header().Name,
-							Rrtype: e.Header().Rrtype,
-							Class:  e.Header().Class,
-							Ttl:    e.Header().Ttl,
-						},
-						A: IpProxy,
-					}
-					change = true
-				}
-			}
-
-			//Tipo PTR
-			if e.Header().Rrtype == dns.TypePTR {
-				ptr := e.(*dns.PTR)
-				if PtrDevice == ptr.Hdr.Name {
-					msg.Extra[i] = &dns.PTR{
-						Hdr: dns.RR_Header{
-							Name:   PtrProxy,
-							Rrtype: e.Header().Rrtype,
-							Class:  e.Header().Class,
-							Ttl:    e.Header().Ttl,
-						},
-						Ptr: ptr.Ptr,
-					}
-					change = true
-				}
-			}
+	// Respuestas para clientes con política propia: van por unicast.
+	audience, multicast := audiencePackets(msg, dir)
+	out = append(out, audience...)
+	if !multicast {
+		return out
+	}
 
-			if change {
-				fmt.Printf("	-%s\n", red(e.String()))
-				fmt.Printf("	+%s\n", blue(msg.Extra[i].String()))
-			} else {
-				fmt.Printf("	%s\n", e.String())
-			}
+	// Los clientes con política preguntan por su proxy.
+	var proxyIP net.IP
+	if dir == ToDevice && src != nil {
+		if p := policyFor(src.IP); p != nil {
+			proxyIP = p.Proxy
 		}
 	}
+	rewriteFor(msg, dir, proxyIP)
+
+	if dir == ToDevice {
+		rememberQuerier(msg, src, iface)
+	}
+
 	//convert msg to []byte
-	r, _ := msg.Pack()
-	return r
+	r, err := msg.Pack()
+	if err != nil {
+		log.Printf("Error al empaquetar el mensaje: %v", err)
+		return out
+	}
+	return append(out, Packet{Data: r})
 }
@@ -0,0 +1,132 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// LinkEvent notifica un cambio de estado de una interfaz.
+type LinkEvent struct {
+	Index int
+	Name  string
+	Up    bool // administrativamente arriba y con portadora
+}
+
+// AddrEvent notifica que se añadió o quitó una dirección de una interfaz.
+type AddrEvent struct {
+	Index   int
+	Family  int // unix.AF_INET o unix.AF_INET6
+	IP      net.IP
+	Deleted bool
+}
+
+// WatchNetlink se suscribe a los eventos de enlaces y direcciones del kernel
+// y llama a onLink/onAddr por cada uno. Bloquea hasta que falle el socket.
+func WatchNetlink(onLink func(LinkEvent), onAddr func(AddrEvent)) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	sa := &unix.SockaddrNetlink{
+		Family: unix.AF_NETLINK,
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	}
+	if err := unix.Bind(fd, sa); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1<<16)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			// ENOBUFS: el kernel descartó eventos, seguimos con los siguientes.
+			if err == unix.EINTR || err == unix.ENOBUFS {
+				continue
+			}
+			return err
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		for i := range msgs {
+			m := &msgs[i]
+			switch m.Header.Type {
+			case unix.RTM_NEWLINK, unix.RTM_DELLINK:
+				if ev, ok := parseLinkMsg(m); ok && onLink != nil {
+					onLink(ev)
+				}
+			case unix.RTM_NEWADDR, unix.RTM_DELADDR:
+				if ev, ok := parseAddrMsg(m); ok && onAddr != nil {
+					onAddr(ev)
+				}
+			}
+		}
+	}
+}
+
+// parseLinkMsg decodifica un ifinfomsg con sus atributos.
+func parseLinkMsg(m *syscall.NetlinkMessage) (LinkEvent, bool) {
+	if len(m.Data) < unix.SizeofIfInfomsg {
+		return LinkEvent{}, false
+	}
+	ev := LinkEvent{Index: int(int32(binary.NativeEndian.Uint32(m.Data[4:8])))}
+	flags := binary.NativeEndian.Uint32(m.Data[8:12])
+	ev.Up = m.Header.Type == unix.RTM_NEWLINK &&
+		flags&unix.IFF_UP != 0 && flags&unix.IFF_RUNNING != 0
+
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return LinkEvent{}, false
+	}
+	for _, a := range attrs {
+		if a.Attr.Type == unix.IFLA_IFNAME {
+			ev.Name = cString(a.Value)
+		}
+	}
+	return ev, true
+}
+
+// parseAddrMsg decodifica un ifaddrmsg con sus atributos.
+func parseAddrMsg(m *syscall.NetlinkMessage) (AddrEvent, bool) {
+	if len(m.Data) < unix.SizeofIfAddrmsg {
+		return AddrEvent{}, false
+	}
+	ev := AddrEvent{
+		Index:   int(binary.NativeEndian.Uint32(m.Data[4:8])),
+		Family:  int(m.Data[0]),
+		Deleted: m.Header.Type == unix.RTM_DELADDR,
+	}
+
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return AddrEvent{}, false
+	}
+	for _, a := range attrs {
+		switch a.Attr.Type {
+		case unix.IFA_LOCAL:
+			// En enlaces punto a punto IFA_ADDRESS es la del otro extremo.
+			ev.IP = net.IP(append([]byte(nil), a.Value...))
+		case unix.IFA_ADDRESS:
+			if ev.IP == nil {
+				ev.IP = net.IP(append([]byte(nil), a.Value...))
+			}
+		}
+	}
+	return ev, ev.IP != nil
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PortMapping es una entrada del mapa de puertos de Redirect: lo que llega a
+// Listen se reenvía a uno de Upstreams.
+type PortMapping struct {
+	Listen    string        // ip:puerto de escucha
+	Upstreams []string      // ip:puerto de destino; varios son réplicas
+	Balance   string        // reparto entre Upstreams (BalanceFailover...)
+	Check     string        // comprobación de salud (CheckTCP...)
+	Timeout   time.Duration // para conectar con Upstreams; 0 es dialTimeout
+	Log       bool          // registrar cada conexión
+	ProxyIn   []*net.IPNet  // balanceadores de confianza que envían la cabecera PROXY
+	ProxyOut  int           // versión de la cabecera PROXY al destino (1 o 2); 0 ninguna
+	KeepIP    bool          // conectar con Upstreams desde la IP del cliente
+	ACL       []ACLRule     // antes que las de ACLs
+}
+
+// PortMap sustituye a los puertos del perfil si no está vacío. Escuchando en
+// IPs de proxy concretas, varios dispositivos pueden usar el mismo puerto.
+var PortMap []PortMapping
+
+// ParsePortMapping lee
+// "10.0.0.5:8009=192.168.2.172:8009[,upstream=192.168.2.173:8009][,balance=roundrobin][,check=tls]
+// [,timeout=5s][,log=false][,proxy-in=10.0.0.5][,proxy-out=2][,keep-ip=true][,acl=allow:10.0.0.0/8]...".
+func ParsePortMapping(s string) (PortMapping, error) {
+	parts := strings.Split(s, ",")
+	listen, upstream, ok := strings.Cut(parts[0], "=")
+	if !ok {
+		return PortMapping{}, fmt.Errorf("falta '=' en %q", s)
+	}
+	pm := PortMapping{Listen: strings.TrimSpace(listen), Upstreams: []string{strings.TrimSpace(upstream)}, Log: true}
+
+	for _, opt := range parts[1:] {
+		k, v, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch k {
+		case "upstream":
+			pm.Upstreams = append(pm.Upstreams, v)
+		case "balance":
+			if v != BalanceFailover && v != BalanceRoundRobin {
+				return PortMapping{}, fmt.Errorf("reparto no válido %q", v)
+			}
+			pm.Balance = v
+		case "check":
+			if v != CheckTCP && v != CheckTLS && v != CheckNone {
+				return PortMapping{}, fmt.Errorf("comprobación no válida %q", v)
+			}
+			pm.Check = v
+		case "timeout":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return PortMapping{}, err
+			}
+			pm.Timeout = d
+		case "log":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return PortMapping{}, err
+			}
+			pm.Log = b
+		case "proxy-in":
+			n, err := ParseTrustedProxy(v)
+			if err != nil {
+				return PortMapping{}, err
+			}
+			pm.ProxyIn = append(pm.ProxyIn, n)
+		case "proxy-out":
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > 2 {
+				return PortMapping{}, fmt.Errorf("versión PROXY no válida %q", v)
+			}
+			pm.ProxyOut = n
+		case "keep-ip":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return PortMapping{}, err
+			}
+			pm.KeepIP = b
+		case "acl":
+			r, err := ParseACLRule(v)
+			if err != nil {
+				return PortMapping{}, err
+			}
+			pm.ACL = append(pm.ACL, r)
+		default:
+			return PortMapping{}, fmt.Errorf("opción no válida %q", k)
+		}
+	}
+
+	if len(pm.ProxyIn) > 0 {
+		if err := checkProxyACL(pm.ACL); err != nil {
+			return PortMapping{}, err
+		}
+	}
+
+	// Sólo la escucha puede ir sin IP (todas); un destino sin IP, o en
+	// 0.0.0.0, sería el propio proxy.
+	for i, a := range append([]string{pm.Listen}, pm.Upstreams...) {
+		host, port, err := net.SplitHostPort(a)
+		if err != nil {
+			return PortMapping{}, err
+		}
+		ip := net.ParseIP(host)
+		if (host != "" || i > 0) && (ip == nil || (i > 0 && ip.IsUnspecified())) {
+			return PortMapping{}, fmt.Errorf("IP no válida en %q", a)
+		}
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return PortMapping{}, fmt.Errorf("puerto no válido en %q", a)
+		}
+	}
+	return pm, nil
+}
@@ -0,0 +1,101 @@
+package pkg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    PortMapping
+		wantErr bool
+	}{
+		{
+			in:   "10.0.0.5:8009=192.168.2.172:8009",
+			want: PortMapping{Listen: "10.0.0.5:8009", Upstreams: []string{"192.168.2.172:8009"}, Log: true},
+		},
+		{
+			in: "10.0.0.5:8009=192.168.2.172:8009,upstream=192.168.2.173:8009,balance=roundrobin,check=tls,timeout=5s,log=false,proxy-out=2,keep-ip=true",
+			want: PortMapping{
+				Listen:    "10.0.0.5:8009",
+				Upstreams: []string{"192.168.2.172:8009", "192.168.2.173:8009"},
+				Balance:   BalanceRoundRobin,
+				Check:     CheckTLS,
+				Timeout:   5 * time.Second,
+				ProxyOut:  2,
+				KeepIP:    true,
+			},
+		},
+		{
+			in:   ":8009=192.168.2.172:8009",
+			want: PortMapping{Listen: ":8009", Upstreams: []string{"192.168.2.172:8009"}, Log: true},
+		},
+		{in: "10.0.0.5:8009", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:8009,balance=random", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:8009,check=http", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:8009,timeout=5", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:8009,log=quizá", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:8009,proxy-out=3", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:8009,proxy-in=nada", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:8009,acl=permit:all", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:8009,foo=bar", wantErr: true},
+		{in: "10.0.0.5:8009=dispositivo:8009", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:70000", wantErr: true},
+		{in: "10.0.0.5=192.168.2.172:8009", wantErr: true},
+		{in: "10.0.0.5:8009=:8009", wantErr: true},
+		{in: "10.0.0.5:8009=0.0.0.0:8009", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:0", wantErr: true},
+		{in: "10.0.0.5:0=192.168.2.172:8009", wantErr: true},
+		{in: "10.0.0.5:8009=192.168.2.172:8009,upstream=:8009", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePortMapping(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParsePortMapping(%q) = %+v, se esperaba error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePortMapping(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParsePortMapping(%q) = %+v, se esperaba %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParsePortMappingProxyInAndACL(t *testing.T) {
+	pm, err := ParsePortMapping("10.0.0.5:8009=192.168.2.172:8009,proxy-in=10.0.0.1,proxy-in=10.1.0.0/16,acl=allow:10.0.0.0/8,acl=deny:all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var proxies []string
+	for _, n := range pm.ProxyIn {
+		proxies = append(proxies, n.String())
+	}
+	if want := []string{"10.0.0.1/32", "10.1.0.0/16"}; !reflect.DeepEqual(proxies, want) {
+		t.Errorf("ProxyIn = %v, se esperaba %v", proxies, want)
+	}
+	var rules []string
+	for _, r := range pm.ACL {
+		rules = append(rules, r.String())
+	}
+	if want := []string{"allow:10.0.0.0/8", "deny:all"}; !reflect.DeepEqual(rules, want) {
+		t.Errorf("ACL = %v, se esperaba %v", rules, want)
+	}
+}
+
+func TestParsePortMappingProxyInNeighborRules(t *testing.T) {
+	for _, s := range []string{
+		"10.0.0.5:8009=192.168.2.172:8009,proxy-in=10.0.0.1,acl=allow:mac=aa:bb:cc:dd:ee:ff",
+		"10.0.0.5:8009=192.168.2.172:8009,acl=deny:iface=eth1,proxy-in=10.0.0.1",
+	} {
+		if _, err := ParsePortMapping(s); err == nil {
+			t.Errorf("ParsePortMapping(%q): se esperaba error", s)
+		}
+	}
+}
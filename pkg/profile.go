@@ -0,0 +1,141 @@
+package pkg
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Profile agrupa lo que necesita un ecosistema para funcionar a través del
+// proxy: qué servicios preguntar, qué reescribir y qué puertos reenviar.
+type Profile struct {
+	Services []string          // tipos de servicio mDNS
+	Ports    map[uint16]uint16 // puerto del SRV del dispositivo -> puerto anunciado
+	Txt      []string          // claves del TXT cuyo valor lleva la IP del dispositivo
+	TCP      []int             // puertos TCP que reenvía Redirect
+	UDP      []int             // puertos UDP del servicio
+}
+
+// Profiles son los perfiles incluidos. Los puertos que cada dispositivo
+// anuncie en sus SRV además de estos también hay que reenviarlos.
+var Profiles = map[string]Profile{
+	"googlecast": {
+		Services: []string{"_googlecast._tcp.local."},
+		TCP:      []int{8008, 8009},
+	},
+	"googlezone": {
+		Services: []string{"_googlezone._tcp.local."},
+		TCP:      []int{10001},
+	},
+	"airplay": {
+		Services: []string{"_airplay._tcp.local."},
+		TCP:      []int{7000, 7100},
+		UDP:      []int{6000, 6001, 6002, 7010, 7011},
+	},
+	"raop": {
+		Services: []string{"_raop._tcp.local."},
+		TCP:      []int{7000},
+		UDP:      []int{6000, 6001, 6002},
+	},
+	"spotify-connect": {
+		// El puerto (zeroconf) lo elige cada dispositivo y va en el SRV.
+		Services: []string{"_spotify-connect._tcp.local."},
+	},
+	"ipp": {
+		Services: []string{"_ipp._tcp.local.", "_ipps._tcp.local."},
+		Txt:      []string{"adminurl"},
+		TCP:      []int{631},
+	},
+}
+
+// ActiveProfile es la combinación de los perfiles elegidos.
+var ActiveProfile = Profiles["googlecast"]
+
+// UseProfiles combina los perfiles indicados por nombre en ActiveProfile.
+func UseProfiles(names []string) error {
+	var p Profile
+	p.Ports = map[uint16]uint16{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		pr, ok := Profiles[name]
+		if !ok {
+			return fmt.Errorf("perfil desconocido %q (hay: %s)", name, strings.Join(ProfileNames(), ", "))
+		}
+		p.Services = appendUnique(p.Services, pr.Services...)
+		p.Txt = appendUnique(p.Txt, pr.Txt...)
+		p.TCP = appendUnique(p.TCP, pr.TCP...)
+		p.UDP = appendUnique(p.UDP, pr.UDP...)
+		for from, to := range pr.Ports {
+			p.Ports[from] = to
+		}
+	}
+	ActiveProfile = p
+	return nil
+}
+
+// ParsePortRemap lee "PUERTO_DISPOSITIVO=PUERTO_ANUNCIADO" (p. ej.
+// "8009=8010"), para anunciar y escuchar en otro puerto que el del
+// dispositivo; así varios dispositivos pueden compartir la IP del proxy.
+func ParsePortRemap(s string) (from, to uint16, err error) {
+	f, t, ok := strings.Cut(s, "=")
+	if !ok {
+		return 0, 0, fmt.Errorf("falta '=' en %q", s)
+	}
+	a, err1 := strconv.ParseUint(strings.TrimSpace(f), 10, 16)
+	b, err2 := strconv.ParseUint(strings.TrimSpace(t), 10, 16)
+	if err1 != nil || err2 != nil || a == 0 || b == 0 {
+		return 0, 0, fmt.Errorf("puertos no válidos en %q", s)
+	}
+	return uint16(a), uint16(b), nil
+}
+
+// ProfileNames devuelve los nombres de los perfiles incluidos.
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for n := range Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// devicePort devuelve el puerto del dispositivo al que va una conexión que
+// llegó al puerto anunciado port.
+func devicePort(port int) int {
+	for from, to := range ActiveProfile.Ports {
+		if int(to) == port {
+			return int(from)
+		}
+	}
+	return port
+}
+
+// advertisedPort devuelve el puerto a anunciar para el puerto del
+// dispositivo port.
+func advertisedPort(port uint16) uint16 {
+	if to, ok := ActiveProfile.Ports[port]; ok {
+		return to
+	}
+	return port
+}
+
+// txtRewrites indica si la clave del TXT lleva la IP del dispositivo.
+func txtRewrites(key string) bool {
+	for _, k := range ActiveProfile.Txt {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendUnique[T comparable](s []T, v ...T) []T {
+	for _, x := range v {
+		if !slices.Contains(s, x) {
+			s = append(s, x)
+		}
+	}
+	return s
+}
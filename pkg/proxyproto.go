@@ -0,0 +1,226 @@
+package pkg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol (v1 en texto, v2 binario), para recibir la dirección real
+// del cliente de un balanceador delante (HAProxy...) y pasársela al destino.
+
+// ProxyProtoIn son los balanceadores de confianza de los puertos del perfil
+// y de los SRV. Si hay alguno, cada conexión tiene que venir de uno de ellos
+// y empezar por la cabecera PROXY; las demás se rechazan, porque la cabecera
+// deja elegir la IP de origen (y, con keep-ip, suplantarla).
+var ProxyProtoIn []*net.IPNet
+
+// ParseTrustedProxy lee un balanceador de confianza: una IP o una subred.
+func ParseTrustedProxy(s string) (*net.IPNet, error) {
+	n, err := parseNet(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("proxy de confianza no válido %q", s)
+	}
+	return n, nil
+}
+
+// trustedProxy indica si ip es uno de los balanceadores trusted.
+func trustedProxy(trusted []*net.IPNet, ip net.IP) bool {
+	for _, n := range trusted {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyProtoOut es la versión de la cabecera PROXY (1 o 2) que se envía al
+// destino desde los puertos del perfil y de los SRV; 0 no la envía.
+var ProxyProtoOut int
+
+// proxyHeaderTimeout es cuánto se espera a la cabecera PROXY.
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn es una conexión cuya cabecera PROXY ya se leyó: sus direcciones
+// son las que decía la cabecera.
+type proxyConn struct {
+	net.Conn
+	r             *bufio.Reader
+	remote, local net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxyConn) LocalAddr() net.Addr        { return c.local }
+
+func (c *proxyConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// readProxyHeader lee la cabecera PROXY (v1 o v2) del principio de c y
+// devuelve una conexión con las direcciones que trae. Con LOCAL o UNKNOWN
+// se quedan las de c.
+func readProxyHeader(c net.Conn) (net.Conn, error) {
+	c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	pc := &proxyConn{Conn: c, r: bufio.NewReader(c), remote: c.RemoteAddr(), local: c.LocalAddr()}
+	sig, err := pc.r.Peek(len(proxyV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("sin cabecera PROXY: %w", err)
+	}
+	if bytes.Equal(sig, proxyV2Sig) {
+		err = pc.readV2()
+	} else {
+		err = pc.readV1()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 lee "PROXY TCP4 origen destino puerto-origen puerto-destino\r\n".
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < 107 {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return errors.New("cabecera PROXY v1 no válida")
+	}
+	f := strings.Fields(s)
+	if len(f) < 2 || f[0] != "PROXY" {
+		return errors.New("cabecera PROXY v1 no válida")
+	}
+	if f[1] == "UNKNOWN" {
+		return nil
+	}
+	if (f[1] != "TCP4" && f[1] != "TCP6") || len(f) != 6 {
+		return fmt.Errorf("cabecera PROXY v1 no válida: %q", s)
+	}
+	src, err := tcpAddr(f[2], f[4])
+	if err != nil {
+		return err
+	}
+	dst, err := tcpAddr(f[3], f[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func tcpAddr(ip, port string) (*net.TCPAddr, error) {
+	a := net.ParseIP(ip)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if a == nil || err != nil {
+		return nil, fmt.Errorf("dirección no válida en la cabecera PROXY: %s %s", ip, port)
+	}
+	return &net.TCPAddr{IP: a, Port: int(p)}, nil
+}
+
+// readV2 lee la cabecera binaria: firma, versión y comando, familia,
+// longitud y direcciones.
+func (c *proxyConn) readV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("versión PROXY no soportada: %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+
+	switch hdr[12] & 0xf {
+	case 0: // LOCAL: comprobaciones del balanceador
+		return nil
+	case 1: // PROXY
+	default:
+		return fmt.Errorf("comando PROXY no válido: %d", hdr[12]&0xf)
+	}
+
+	var n int
+	switch hdr[13] {
+	case 0x11: // TCP sobre IPv4
+		n = net.IPv4len
+	case 0x21: // TCP sobre IPv6
+		n = net.IPv6len
+	default:
+		return nil // familia sin direcciones que nos sirvan
+	}
+	if len(body) < 2*n+4 {
+		return errors.New("cabecera PROXY v2 corta")
+	}
+	c.remote = &net.TCPAddr{IP: net.IP(body[:n]), Port: int(binary.BigEndian.Uint16(body[2*n:]))}
+	c.local = &net.TCPAddr{IP: net.IP(body[n : 2*n]), Port: int(binary.BigEndian.Uint16(body[2*n+2:]))}
+	return nil
+}
+
+// writeProxyHeader envía a w la cabecera PROXY de la versión indicada con
+// las direcciones de src (cliente) y dst (a donde se conectó).
+func writeProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	s, ok1 := src.(*net.TCPAddr)
+	d, ok2 := dst.(*net.TCPAddr)
+	v4 := ok1 && ok2 && s.IP.To4() != nil && d.IP.To4() != nil
+
+	switch version {
+	case 1:
+		var line string
+		switch {
+		case !ok1 || !ok2:
+			line = "PROXY UNKNOWN\r\n"
+		case v4:
+			line = fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", s.IP.To4(), d.IP.To4(), s.Port, d.Port)
+		default:
+			line = fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", s.IP.To16(), d.IP.To16(), s.Port, d.Port)
+		}
+		_, err := io.WriteString(w, line)
+		return err
+
+	case 2:
+		b := append([]byte(nil), proxyV2Sig...)
+		var addrs []byte
+		switch {
+		case !ok1 || !ok2:
+			b = append(b, 0x20, 0x00) // LOCAL, sin direcciones
+		case v4:
+			b = append(b, 0x21, 0x11)
+			addrs = append(append(addrs, s.IP.To4()...), d.IP.To4()...)
+		default:
+			b = append(b, 0x21, 0x21)
+			addrs = append(append(addrs, s.IP.To16()...), d.IP.To16()...)
+		}
+		if addrs != nil {
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(s.Port))
+			addrs = binary.BigEndian.AppendUint16(addrs, uint16(d.Port))
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(addrs)))
+		_, err := w.Write(append(b, addrs...))
+		return err
+	}
+	return fmt.Errorf("versión PROXY no válida: %d", version)
+}
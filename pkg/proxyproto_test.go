@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// proxyRead pasa raw por un net.Pipe y lo lee con readProxyHeader.
+func proxyRead(t *testing.T, raw []byte) (net.Conn, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	go func() {
+		client.Write(raw)
+		client.Close()
+	}()
+	return readProxyHeader(server)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, fam byte, body ...byte) []byte {
+		b := append([]byte(nil), proxyV2Sig...)
+		b = append(b, cmd, fam, byte(len(body)>>8), byte(len(body)))
+		return append(b, body...)
+	}
+	tests := []struct {
+		name     string
+		raw      []byte
+		src, dst string // "" si se quedan las de la conexión
+		wantErr  bool
+	}{
+		{name: "v1 TCP4", raw: []byte("PROXY TCP4 192.168.1.10 10.0.0.5 40000 8009\r\n"), src: "192.168.1.10:40000", dst: "10.0.0.5:8009"},
+		{name: "v1 TCP6", raw: []byte("PROXY TCP6 fd00::10 fd00::5 40000 8009\r\n"), src: "[fd00::10]:40000", dst: "[fd00::5]:8009"},
+		{name: "v1 UNKNOWN", raw: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 sin CRLF", raw: []byte("PROXY TCP4 192.168.1.10 10.0.0.5 40000 8009\n"), wantErr: true},
+		{name: "v1 protocolo", raw: []byte("PROXY UDP4 192.168.1.10 10.0.0.5 40000 8009\r\n"), wantErr: true},
+		{name: "v1 campos", raw: []byte("PROXY TCP4 192.168.1.10 10.0.0.5 40000\r\n"), wantErr: true},
+		{name: "v1 IP", raw: []byte("PROXY TCP4 equipo 10.0.0.5 40000 8009\r\n"), wantErr: true},
+		{name: "v1 puerto", raw: []byte("PROXY TCP4 192.168.1.10 10.0.0.5 70000 8009\r\n"), wantErr: true},
+		{name: "sin cabecera", raw: []byte("GET / HTTP/1.1\r\n\r\n"), wantErr: true},
+		{name: "corta", raw: []byte("PROXY"), wantErr: true},
+		{
+			name: "v2 TCP4",
+			raw:  v2(0x21, 0x11, 192, 168, 1, 10, 10, 0, 0, 5, 0x9c, 0x40, 0x1f, 0x49),
+			src:  "192.168.1.10:40000", dst: "10.0.0.5:8009",
+		},
+		{name: "v2 LOCAL", raw: v2(0x20, 0x00)},
+		{name: "v2 familia desconocida", raw: v2(0x21, 0x31, make([]byte, 216)...)},
+		{name: "v2 versión", raw: v2(0x11, 0x11, make([]byte, 12)...), wantErr: true},
+		{name: "v2 comando", raw: v2(0x22, 0x11, make([]byte, 12)...), wantErr: true},
+		{name: "v2 corta", raw: v2(0x21, 0x11, 192, 168, 1, 10), wantErr: true},
+	}
+	for _, tt := range tests {
+		c, err := proxyRead(t, tt.raw)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: se esperaba error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if tt.src == "" {
+			if _, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+				t.Errorf("%s: RemoteAddr = %v, se esperaba la de la conexión", tt.name, c.RemoteAddr())
+			}
+			continue
+		}
+		if got := c.RemoteAddr().String(); got != tt.src {
+			t.Errorf("%s: RemoteAddr = %s, se esperaba %s", tt.name, got, tt.src)
+		}
+		if got := c.LocalAddr().String(); got != tt.dst {
+			t.Errorf("%s: LocalAddr = %s, se esperaba %s", tt.name, got, tt.dst)
+		}
+	}
+}
+
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		src, dst net.Addr
+		want     string // RemoteAddr leída; "" si se queda la de la conexión
+	}{
+		{"v1 IPv4", 1, &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 8009}, "192.168.1.10:40000"},
+		{"v1 IPv6", 1, &net.TCPAddr{IP: net.ParseIP("fd00::10"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("fd00::5"), Port: 8009}, "[fd00::10]:40000"},
+		{"v1 sin TCP", 1, &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 8009}, ""},
+		{"v2 IPv4", 2, &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 8009}, "192.168.1.10:40000"},
+		{"v2 IPv6", 2, &net.TCPAddr{IP: net.ParseIP("fd00::10"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("fd00::5"), Port: 8009}, "[fd00::10]:40000"},
+		{"v2 sin TCP", 2, &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 8009}, ""},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := writeProxyHeader(&buf, tt.version, tt.src, tt.dst); err != nil {
+			t.Errorf("%s: writeProxyHeader: %v", tt.name, err)
+			continue
+		}
+		buf.WriteString("hola")
+
+		c, err := proxyRead(t, buf.Bytes())
+		if err != nil {
+			t.Errorf("%s: readProxyHeader: %v", tt.name, err)
+			continue
+		}
+		got := ""
+		if a, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			got = a.String()
+			if c.LocalAddr().String() != tt.dst.String() {
+				t.Errorf("%s: LocalAddr = %s, se esperaba %s", tt.name, c.LocalAddr(), tt.dst)
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s: RemoteAddr = %q, se esperaba %q", tt.name, got, tt.want)
+		}
+		// Lo que sigue a la cabecera llega intacto.
+		if rest, _ := io.ReadAll(c); string(rest) != "hola" {
+			t.Errorf("%s: tras la cabecera se leyó %q", tt.name, rest)
+		}
+	}
+
+	if err := writeProxyHeader(io.Discard, 3, nil, nil); err == nil {
+		t.Error("writeProxyHeader con versión 3: se esperaba error")
+	}
+}
@@ -0,0 +1,246 @@
+package pkg
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Intervalos de las consultas continuas (RFC 6762 §5.2): empiezan en un
+// segundo y se duplican hasta una hora.
+const (
+	queryMinInterval = time.Second
+	queryMaxInterval = time.Hour
+)
+
+// querySearchInterval es el máximo entre consultas mientras se busca el
+// dispositivo por nombre.
+const querySearchInterval = 5 * time.Second
+
+// cacheFlush es el bit alto de la clase en las respuestas mDNS.
+const cacheFlush = 1 << 15
+
+// Porcentajes del TTL a los que se pide refrescar un registro.
+var refreshPoints = []float64{0.80, 0.85, 0.90, 0.95}
+
+// Querier pregunta activamente por los servicios del dispositivo y refresca
+// sus registros antes de que caduquen, para que la caché esté siempre al día.
+type Querier struct {
+	iface string
+	send  func([]byte) error
+
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+	records  map[string]*cachedRR
+}
+
+type cachedRR struct {
+	rr       dns.RR
+	received time.Time
+	jitter   float64 // 0-2% extra para no preguntar todos a la vez
+	asked    int     // refrescos ya pedidos
+}
+
+// NewQuerier crea el consultor para la interfaz iface; send envía un
+// paquete al grupo mDNS por esa interfaz.
+func NewQuerier(iface string, send func([]byte) error) *Querier {
+	q := &Querier{
+		iface:    iface,
+		send:     send,
+		interval: queryMinInterval,
+		next:     time.Now(),
+		records:  map[string]*cachedRR{},
+	}
+	OnPacket(q.observe)
+	queriers.Lock()
+	queriers.list = append(queriers.list, q)
+	queriers.Unlock()
+	return q
+}
+
+// queriers son los Querier creados, para la API.
+var queriers = struct {
+	sync.Mutex
+	list []*Querier
+}{}
+
+// CachedRecords son los registros que tiene en caché el Querier de una
+// interfaz, para la API.
+type CachedRecords struct {
+	Iface   string   `json:"iface"`
+	Records []string `json:"records"`
+}
+
+// DeviceRecords devuelve los registros del dispositivo de todos los Querier,
+// con el TTL que les queda.
+func DeviceRecords() []CachedRecords {
+	queriers.Lock()
+	list := append([]*Querier(nil), queriers.list...)
+	queriers.Unlock()
+
+	var out []CachedRecords
+	for _, q := range list {
+		c := CachedRecords{Iface: q.iface, Records: []string{}}
+		for _, rr := range q.Records() {
+			c.Records = append(c.Records, rr.String())
+		}
+		sort.Strings(c.Records)
+		out = append(out, c)
+	}
+	return out
+}
+
+// Run envía las consultas periódicas y los refrescos. No retorna.
+func (q *Querier) Run() {
+	t := time.NewTicker(250 * time.Millisecond)
+	defer t.Stop()
+	for now := range t.C {
+		q.tick(now)
+	}
+}
+
+// Restart vuelve a empezar el back-off, por ejemplo al reabrir la interfaz.
+func (q *Querier) Restart() {
+	q.mu.Lock()
+	q.interval = queryMinInterval
+	q.next = time.Now()
+	q.mu.Unlock()
+}
+
+func (q *Querier) tick(now time.Time) {
+	var questions []dns.Question
+
+	q.mu.Lock()
+	if !now.Before(q.next) {
+		for _, s := range DeviceServices {
+			questions = append(questions, dns.Question{Name: s, Qtype: dns.TypePTR, Qclass: dns.ClassINET})
+		}
+		q.next = now.Add(q.interval)
+		q.interval *= 2
+		if q.interval > queryMaxInterval {
+			q.interval = queryMaxInterval
+		}
+		if q.interval > querySearchInterval && byName.searching() {
+			q.interval = querySearchInterval
+		}
+	}
+
+	for k, c := range q.records {
+		ttl := time.Duration(c.rr.Header().Ttl) * time.Second
+		age := now.Sub(c.received)
+		if age >= ttl {
+			delete(q.records, k)
+			continue
+		}
+		if c.asked < len(refreshPoints) &&
+			age >= time.Duration(float64(ttl)*(refreshPoints[c.asked]+c.jitter)) {
+			c.asked++
+			questions = appendQuestion(questions, dns.Question{
+				Name:   c.rr.Header().Name,
+				Qtype:  c.rr.Header().Rrtype,
+				Qclass: dns.ClassINET,
+			})
+		}
+	}
+	q.mu.Unlock()
+
+	if len(questions) == 0 {
+		return
+	}
+	m := new(dns.Msg)
+	m.RecursionDesired = false
+	m.Question = questions
+	b, err := packLocal(m)
+	if err != nil {
+		log.Printf("Error al empaquetar la consulta: %v", err)
+		return
+	}
+	if err := q.send(b); err != nil {
+		log.Printf("Error al enviar la consulta por %s: %v", q.iface, err)
+	}
+}
+
+func appendQuestion(qs []dns.Question, q dns.Question) []dns.Question {
+	for _, x := range qs {
+		if x == q {
+			return qs
+		}
+	}
+	return append(qs, q)
+}
+
+// observe guarda los registros que anuncia el dispositivo.
+func (q *Querier) observe(msg *dns.Msg, src *net.UDPAddr, iface string) {
+	if !msg.Response || iface != q.iface {
+		return
+	}
+	if ip, _ := device(); ip != nil && !ip.Equal(src.IP) {
+		return
+	}
+
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range sec {
+			if rr.Header().Rrtype == dns.TypeOPT || rr.Header().Rrtype == dns.TypeNSEC {
+				continue
+			}
+			k := rrKey(rr)
+			if rr.Header().Ttl == 0 {
+				delete(q.records, k)
+				continue
+			}
+			if rr.Header().Class&cacheFlush != 0 {
+				// Cache-flush: los registros anteriores del mismo nombre y
+				// tipo dejan de valer (RFC 6762 §10.2).
+				for ok, c := range q.records {
+					if c.rr.Header().Rrtype == rr.Header().Rrtype &&
+						strings.EqualFold(c.rr.Header().Name, rr.Header().Name) &&
+						now.Sub(c.received) > time.Second {
+						delete(q.records, ok)
+					}
+				}
+			}
+			q.records[k] = &cachedRR{
+				rr:       dns.Copy(rr),
+				received: now,
+				jitter:   rand.Float64() * 0.02,
+			}
+		}
+	}
+}
+
+// Records devuelve los registros del dispositivo con el TTL que les queda.
+func (q *Querier) Records() []dns.RR {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var out []dns.RR
+	for _, c := range q.records {
+		age := uint32(now.Sub(c.received) / time.Second)
+		if age >= c.rr.Header().Ttl {
+			continue
+		}
+		rr := dns.Copy(c.rr)
+		rr.Header().Ttl -= age
+		out = append(out, rr)
+	}
+	return out
+}
+
+// rrKey identifica un registro por nombre, tipo y datos, sin el TTL.
+func rrKey(rr dns.RR) string {
+	c := dns.Copy(rr)
+	c.Header().Ttl = 0
+	c.Header().Class &^= cacheFlush
+	return strings.ToLower(c.Header().Name) + "|" + c.String()
+}
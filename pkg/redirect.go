@@ -1,7 +1,9 @@
 package pkg
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -10,9 +12,11 @@ import (
 )
 
 // pipeAndPrint copia datos entre dos conexiones y los imprime en consola.
-func pipeAndPrint(src net.Conn, dst net.Conn, direction string) {
-	defer src.Close()
-	defer dst.Close()
+// Al terminar la lectura cierra sólo la escritura de dst (FIN); cerrar las
+// conexiones le toca a quien llama. Devuelve los bytes copiados y el error
+// que la cortó (nil si src terminó normalmente).
+func pipeAndPrint(src net.Conn, dst net.Conn, direction string) (int64, error) {
+	var total int64
 
 	buf := make([]byte, 65535) // Buffer grande para capturar paquetes completos
 	for {
@@ -20,8 +24,12 @@ func pipeAndPrint(src net.Conn, dst net.Conn, direction string) {
 		if err != nil {
 			if err != io.EOF {
 				log.Printf("Error de lectura en %s: %v", direction, err)
+				src.Close()
+				dst.Close()
+				return total, err
 			}
-			break
+			halfClose(dst)
+			return total, nil
 		}
 		data := buf[:n]
 
@@ -37,13 +45,17 @@ func pipeAndPrint(src net.Conn, dst net.Conn, direction string) {
 		_, err = dst.Write(data)
 		if err != nil {
 			log.Printf("Error de escritura en %s: %v", direction, err)
-			break
+			src.Close()
+			dst.Close()
+			return total, err
 		}
+		total += int64(n)
 	}
 }
 
-// RedirectTLS inicia el listener del proxy MITM.
-func RedirectTLS() {
+// RedirectTLS inicia el listener del proxy MITM. Cuando se cancela ctx deja
+// de aceptar y drena las sesiones como Redirect (ver DrainTimeout).
+func RedirectTLS(ctx context.Context) {
 	caCert, caKey := loadOrCreateCA()
 
 	// Cache para los certificados generados, para no recrearlos cada vez.
@@ -55,9 +67,13 @@ func RedirectTLS() {
 			// El cliente nos dice a qué servidor quiere conectarse vía SNI
 			serverName := hello.ServerName
 			if serverName == "" {
-				// Si SNI no está presente, podríamos usar la IP de destino.
+				// Si SNI no está presente, usamos la IP de destino.
 				// Para Chromecast, SNI es fundamental.
-				serverName = "192.168.2.172" // IP por defecto
+				target, err := tlsTarget(hello.Conn)
+				if err != nil {
+					return nil, err
+				}
+				serverName, _, _ = net.SplitHostPort(target)
 			}
 
 			log.Printf("Recibida petición TLS para: %s", serverName)
@@ -81,49 +97,119 @@ func RedirectTLS() {
 		},
 	}
 
-	ln, err := tls.Listen("tcp", "0.0.0.0:8009", tlsConfig)
+	ln, err := listenTCP("0.0.0.0:8009", Transparent == TransparentTProxy)
 	if err != nil {
 		log.Fatalf("Error al iniciar el listener TLS: %v", err)
 	}
 	defer ln.Close()
+	if !drainListener(ln) {
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownTCP()
+	}()
 
-	ipDevice := "192.168.2.172"
 	log.Println("Escuchando en el puerto 8009 (con inspección TLS)")
 
 	for {
-		clientConn, err := ln.Accept()
+		rawConn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("Error al aceptar conexión: %v", err)
 			continue
 		}
+		s := trackSession("0.0.0.0:8009", rawConn, false)
+		target, err := tlsTarget(rawConn)
+		if err != nil {
+			log.Printf("Sin destino para %s: %v", rawConn.RemoteAddr(), err)
+			s.abort("sin destino: " + err.Error())
+			continue
+		}
 
-		go handleConnection(clientConn, ipDevice)
+		clientConn := tls.Server(rawConn, tlsConfig)
+		s.setConns(clientConn, nil)
+		go handleConnection(s, clientConn, target)
 	}
 }
 
-func handleConnection(clientConn net.Conn, ipDevice string) {
+// tlsTarget es el destino (ip:puerto) de la conexión c del proxy MITM: el
+// original en modo transparente o, si no, el puerto 8009 del dispositivo.
+func tlsTarget(c net.Conn) (string, error) {
+	if Transparent != "" {
+		return transparentTarget(c, Transparent)
+	}
+	ipDevice, _ := device()
+	if ipDevice == nil {
+		return "", errNoDevice
+	}
+	return net.JoinHostPort(ipDevice.String(), "8009"), nil
+}
+
+func handleConnection(s *tcpSession, clientConn net.Conn, target string) {
 	defer clientConn.Close()
 	fmt.Println("\033[34mNueva conexión TLS desde: ", clientConn.RemoteAddr(), "\033[0m")
 
 	// Conectamos al servidor de destino real (Chromecast) con TLS
-	destConn, err := tls.Dial("tcp", ipDevice+":8009", &tls.Config{
-		// En un caso real, deberías validar el certificado del Chromecast.
-		// Si el Chromecast usa un certificado autofirmado, puede que necesites
-		// InsecureSkipVerify: true, pero es inseguro.
-		// Lo ideal sería añadir la CA del Chromecast a un pool de CAs de confianza.
-		InsecureSkipVerify: false,
-	})
-
+	dialer := &tls.Dialer{
+		NetDialer: upstreamDialer(dialTimeout, clientConn.RemoteAddr(), KeepClientIP),
+		Config: &tls.Config{
+			// En un caso real, deberías validar el certificado del Chromecast.
+			// Si el Chromecast usa un certificado autofirmado, puede que necesites
+			// InsecureSkipVerify: true, pero es inseguro.
+			// Lo ideal sería añadir la CA del Chromecast a un pool de CAs de confianza.
+			InsecureSkipVerify: false,
+		},
+	}
+	c, err := dialer.DialContext(s.ctx, "tcp", target)
 	if err != nil {
-		log.Printf("No se pudo conectar al destino %s: %v", ipDevice, err)
+		log.Printf("No se pudo conectar al destino %s: %v", target, err)
+		s.abort("sin destino: " + err.Error())
 		return
 	}
+	destConn := c.(*tls.Conn)
+
+	log.Printf("Conexión TLS establecida con el destino: %s", target)
 
-	log.Printf("Conexión TLS establecida con el destino: %s", ipDevice)
+	defer destConn.Close()
+
+	s.setConns(clientConn, destConn)
+	if tc, ok := clientConn.(*tls.Conn); ok {
+		// El handshake con el cliente no se hace hasta la primera lectura.
+		if err := tc.HandshakeContext(s.ctx); err != nil {
+			s.abort(err.Error())
+			log.Printf("Error en el handshake TLS con %s: %v", clientConn.RemoteAddr(), err)
+			return
+		}
+		s.setTLS(tc, destConn)
+	}
 
-	// Iniciar el copiado bidireccional con inspección
-	go pipeAndPrint(clientConn, destConn, "cliente -> servidor")
-	pipeAndPrint(destConn, clientConn, "servidor -> cliente")
+	// Iniciar el copiado bidireccional con inspección; seguimos hasta que
+	// terminen las dos direcciones.
+	var bytesIn int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var err error
+		bytesIn, err = pipeAndPrint(clientConn, destConn, "cliente -> servidor")
+		s.setReason(closeReason(err, "cerrada por el cliente"))
+	}()
+	bytesOut, err := pipeAndPrint(destConn, clientConn, "servidor -> cliente")
+	s.setReason(closeReason(err, "cerrada por el destino"))
+	wg.Wait()
+	s.finish(bytesIn, bytesOut)
 
 	fmt.Println("\033[32mConexión cerrada desde: ", clientConn.RemoteAddr(), "\033[0m")
 }
+
+// closeReason es el motivo de cierre de una dirección: el error, o closed
+// si terminó normalmente.
+func closeReason(err error, closed string) string {
+	if err != nil {
+		return err.Error()
+	}
+	return closed
+}
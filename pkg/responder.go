@@ -0,0 +1,148 @@
+package pkg
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Respond activa el modo responder: el proxy contesta en la interfaz de
+// clientes las preguntas A/AAAA por el nombre de host del dispositivo.
+var Respond bool
+
+// hostTTL es el TTL de los registros de host (RFC 6762 §10).
+const hostTTL = 120
+
+var hostnames = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+func init() {
+	OnPacket(learnHostnames)
+}
+
+// AddHostname añade un nombre de host del dispositivo a mano.
+func AddHostname(name string) {
+	hostnames.Lock()
+	defer hostnames.Unlock()
+	hostnames.m[strings.ToLower(dns.Fqdn(name))] = true
+}
+
+// isDeviceHost indica si name es un nombre de host del dispositivo.
+func isDeviceHost(name string) bool {
+	hostnames.Lock()
+	defer hostnames.Unlock()
+	return hostnames.m[strings.ToLower(name)]
+}
+
+// learnHostnames aprende los nombres de host del dispositivo de los SRV y A
+// que anuncia.
+func learnHostnames(msg *dns.Msg, src *net.UDPAddr, iface string) {
+	ipDevice, _ := device()
+	if !msg.Response || src == nil || !src.IP.Equal(ipDevice) {
+		return
+	}
+
+	hostnames.Lock()
+	defer hostnames.Unlock()
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range sec {
+			if rr.Header().Ttl == 0 {
+				continue
+			}
+			switch r := rr.(type) {
+			case *dns.SRV:
+				hostnames.m[strings.ToLower(r.Target)] = true
+			case *dns.A:
+				if r.A.Equal(ipDevice) {
+					hostnames.m[strings.ToLower(r.Hdr.Name)] = true
+				}
+			}
+		}
+	}
+}
+
+// respond contesta en nombre del dispositivo las preguntas por su nombre de
+// host con la IP del proxy que corresponda al cliente.
+func respond(msg *dns.Msg, src *net.UDPAddr, iface string) []Packet {
+	if !Respond || msg.Response || src == nil {
+		return nil
+	}
+
+	ip4, _ := proxy()
+	ip6 := proxy6()
+	if p := policyFor(src.IP); p != nil {
+		ip4, ip6 = p.Proxy, nil
+	}
+
+	var answers []dns.RR
+	unicast := src.Port != MdnsGroup.Port
+	hostnames.Lock()
+	for _, q := range msg.Question {
+		name := strings.ToLower(q.Name)
+		a4, a6 := ip4, ip6
+		if v := virtualHost(name); v != nil {
+			a4, a6 = v.Proxy, nil
+		} else if !hostnames.m[name] {
+			continue
+		}
+		if q.Qclass&cacheFlush != 0 {
+			// Bit QU: el cliente pide respuesta unicast.
+			unicast = true
+		}
+
+		hdr := func(t uint16) dns.RR_Header {
+			return dns.RR_Header{Name: q.Name, Rrtype: t, Class: dns.ClassINET | cacheFlush, Ttl: hostTTL}
+		}
+		if (q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY) && a4 != nil {
+			answers = append(answers, &dns.A{Hdr: hdr(dns.TypeA), A: a4})
+		}
+		if (q.Qtype == dns.TypeAAAA || q.Qtype == dns.TypeANY) && a6 != nil {
+			answers = append(answers, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: a6})
+		}
+	}
+	hostnames.Unlock()
+
+	if len(answers) == 0 {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.Response = true
+	m.Authoritative = true
+	m.Answer = answers
+	var to *net.UDPAddr
+	if unicast {
+		to = src
+		if src.Port != MdnsGroup.Port {
+			// Consulta "legacy" (RFC 6762 §6.7): se repite el id y la
+			// pregunta, y sin el bit cache-flush.
+			m.Id = msg.Id
+			m.Question = msg.Question
+			for _, rr := range m.Answer {
+				rr.Header().Class &^= cacheFlush
+				rr.Header().Ttl = 10
+			}
+		}
+	}
+
+	b, err := packLocal(m)
+	if err != nil {
+		return nil
+	}
+	return []Packet{{Data: b, To: to, Iface: iface}}
+}
+
+// virtualHost devuelve el dispositivo virtual cuyo nombre de host es name.
+func virtualHost(name string) *VirtualDevice {
+	for i := range VirtualDevices {
+		v := &VirtualDevices[i]
+		if name == v.host()+".local." {
+			return v
+		}
+	}
+	return nil
+}
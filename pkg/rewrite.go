@@ -0,0 +1,270 @@
+package pkg
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Direction indica hacia dónde viaja un paquete mDNS.
+type Direction int
+
+const (
+	ToClient Direction = iota // entró por la interfaz de dispositivos
+	ToDevice                  // entró por la interfaz de clientes
+	Local                     // lo genera el propio proxy
+)
+
+func (d Direction) String() string {
+	switch d {
+	case ToClient:
+		return "to-client"
+	case ToDevice:
+		return "to-device"
+	case Local:
+		return "local"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// Mapeos posibles entre las direcciones del dispositivo y del proxy.
+const (
+	MapNone          = ""
+	MapDeviceToProxy = "device->proxy"
+	MapProxyToDevice = "proxy->device"
+)
+
+// Policy son las reescrituras que se aplican en una dirección.
+type Policy struct {
+	Questions string // preguntas PTR
+	Records   string // registros A/PTR de respuestas, autoridad y adicionales
+}
+
+// Policies guarda la política de cada dirección. Por defecto las
+// respuestas hacia los clientes muestran el proxy en lugar del dispositivo
+// y las preguntas hacia el dispositivo preguntan por él en lugar de por el
+// proxy.
+var Policies = map[Direction]Policy{
+	ToClient: {Records: MapDeviceToProxy},
+	ToDevice: {Questions: MapProxyToDevice},
+	Local:    {},
+}
+
+// ParsePolicy lee una política con el formato
+// "questions=proxy->device,records=device->proxy".
+func ParsePolicy(s string) (Policy, error) {
+	var p Policy
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(kv, "=")
+		if v != MapNone && v != MapDeviceToProxy && v != MapProxyToDevice {
+			return p, fmt.Errorf("mapeo no válido %q", v)
+		}
+		switch k {
+		case "questions":
+			p.Questions = v
+		case "records":
+			p.Records = v
+		default:
+			return p, fmt.Errorf("campo no válido %q", k)
+		}
+	}
+	return p, nil
+}
+
+// mapping sustituye una IP (y su PTR) por otra.
+type mapping struct {
+	kind    string
+	fromIP  net.IP
+	fromPtr string
+	toIP    net.IP
+	toPtr   string
+}
+
+// newMapping construye el mapeo con las direcciones actuales; nil si no hay
+// que reescribir nada. Si proxyIP no es nil se usa en lugar de IpProxy.
+func newMapping(kind string, proxyIP net.IP) *mapping {
+	ipDevice, ptrDevice := device()
+	if ipDevice == nil {
+		// Sin dispositivo no hay nada que mapear.
+		return nil
+	}
+	ipProxy, ptrProxy := proxy()
+	if proxyIP != nil {
+		ipProxy, ptrProxy = proxyIP, IpToPtr(proxyIP)
+	}
+	switch kind {
+	case MapDeviceToProxy:
+		return &mapping{kind, ipDevice, ptrDevice, ipProxy, ptrProxy}
+	case MapProxyToDevice:
+		return &mapping{kind, ipProxy, ptrProxy, ipDevice, ptrDevice}
+	}
+	return nil
+}
+
+// question devuelve la pregunta reescrita, o false si no cambia.
+func (m *mapping) question(q dns.Question) (dns.Question, bool) {
+	// Solo nos interesa modificar las consultas de tipo PTR (búsqueda inversa de IP).
+	// NO modificamos las preguntas de tipo A, ya que esas preguntan por un nombre, no una IP.
+	if m == nil || q.Qtype != dns.TypePTR || q.Name != m.fromPtr {
+		return q, false
+	}
+	return dns.Question{Name: m.toPtr, Qtype: q.Qtype, Qclass: q.Qclass}, true
+}
+
+// record devuelve el registro reescrito, o nil si no cambia.
+func (m *mapping) record(rr dns.RR) dns.RR {
+	if m == nil {
+		return nil
+	}
+	hdr := rr.Header()
+	switch r := rr.(type) {
+	// Address
+	case *dns.A:
+		if r.A.To4().Equal(m.fromIP) {
+			return &dns.A{
+				Hdr: dns.RR_Header{
+					Name:   hdr.Name,
+					Rrtype: hdr.Rrtype,
+					Class:  hdr.Class,
+					Ttl:    hdr.Ttl,
+				},
+				A: m.toIP,
+			}
+		}
+	//Tipo PTR
+	case *dns.PTR:
+		if r.Hdr.Name == m.fromPtr {
+			return &dns.PTR{
+				Hdr: dns.RR_Header{
+					Name:   m.toPtr,
+					Rrtype: hdr.Rrtype,
+					Class:  hdr.Class,
+					Ttl:    hdr.Ttl,
+				},
+				Ptr: r.Ptr,
+			}
+		}
+	// Puertos del perfil en los SRV del dispositivo
+	case *dns.SRV:
+		if !isDeviceHost(r.Target) {
+			break
+		}
+		port := advertisedPort(r.Port)
+		if m.kind == MapProxyToDevice {
+			port = uint16(devicePort(int(r.Port)))
+		}
+		if port != r.Port {
+			n := dns.Copy(r).(*dns.SRV)
+			n.Port = port
+			return n
+		}
+	// Campos del TXT que llevan la IP
+	case *dns.TXT:
+		var n *dns.TXT
+		for i, kv := range r.Txt {
+			k, v, ok := strings.Cut(kv, "=")
+			if !ok || !txtRewrites(k) {
+				continue
+			}
+			nv := replaceIP(v, m.fromIP.String(), m.toIP.String())
+			if nv == v {
+				continue
+			}
+			if n == nil {
+				n = dns.Copy(r).(*dns.TXT)
+			}
+			n.Txt[i] = k + "=" + nv
+		}
+		if n != nil {
+			return n
+		}
+	}
+	return nil
+}
+
+// replaceIP sustituye en s la IP from por to allí donde aparezca entera
+// (en una URL, en ip:puerto...), no como parte de otra: 192.168.2.17 no
+// toca 192.168.2.172.
+func replaceIP(s, from, to string) string {
+	part := func(c byte) bool { return c == '.' || isDigit(c) }
+	var b strings.Builder
+	for {
+		i := strings.Index(s, from)
+		if i < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := i + len(from)
+		whole := (i == 0 || !part(s[i-1])) && (end == len(s) || !part(s[end]))
+		b.WriteString(s[:i])
+		if whole {
+			b.WriteString(to)
+		} else {
+			b.WriteString(from)
+		}
+		s = s[end:]
+	}
+}
+
+// rewrite aplica la política de la dirección dir a msg y muestra los
+// cambios por consola.
+func rewrite(msg *dns.Msg, dir Direction) {
+	rewriteFor(msg, dir, nil)
+}
+
+// rewriteFor es como rewrite pero usando proxyIP como IP del proxy (para
+// las políticas por cliente).
+func rewriteFor(msg *dns.Msg, dir Direction, proxyIP net.IP) {
+	pol := Policies[dir]
+	qm := newMapping(pol.Questions, proxyIP)
+	rm := newMapping(pol.Records, proxyIP)
+
+	// Imprime la sección de Preguntas (si existe)
+	if len(msg.Question) > 0 {
+		fmt.Println("--- Preguntas ---")
+		for i, q := range msg.Question {
+			if nq, ok := qm.question(q); ok {
+				msg.Question[i] = nq
+				fmt.Printf("	-%s\n", red(q.String()))
+				fmt.Printf("	+%s\n", blue(nq.String()))
+			} else {
+				fmt.Printf("	%s\n", q.String())
+			}
+		}
+	}
+
+	rewriteSection("Respuestas", msg.Answer, rm)
+	rewriteSection("Autoridad", msg.Ns, rm)
+	rewriteSection("Registros Adicionales", msg.Extra, rm)
+}
+
+func rewriteSection(title string, rrs []dns.RR, m *mapping) {
+	if len(rrs) == 0 {
+		return
+	}
+	fmt.Printf("--- %s ---\n", title)
+	for i, rr := range rrs {
+		if n := m.record(rr); n != nil {
+			rrs[i] = n
+			fmt.Printf("	-%s\n", red(rr.String()))
+			fmt.Printf("	+%s\n", blue(n.String()))
+		} else {
+			fmt.Printf("	%s\n", rr.String())
+		}
+	}
+}
+
+// packLocal aplica la política Local a un mensaje generado por el proxy y
+// lo empaqueta.
+func packLocal(msg *dns.Msg) ([]byte, error) {
+	fmt.Println("--------------------------------------------------")
+	fmt.Println("Paquete DNS generado por el proxy:")
+	rewrite(msg, Local)
+	return msg.Pack()
+}
@@ -0,0 +1,162 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testAddrs deja como dispositivo 192.168.2.172 (con nombre de host
+// tv.local.) y como proxy 10.0.0.5, y lo restaura al terminar el test.
+func testAddrs(t *testing.T) {
+	t.Helper()
+	dev, pdev, prx, pprx, prx6 := IpDevice, PtrDevice, IpProxy, PtrProxy, IpProxy6
+	profile := ActiveProfile
+	t.Cleanup(func() {
+		IpDevice, PtrDevice, IpProxy, PtrProxy, IpProxy6 = dev, pdev, prx, pprx, prx6
+		ActiveProfile = profile
+		hostnames.Lock()
+		delete(hostnames.m, "tv.local.")
+		hostnames.Unlock()
+	})
+	SetDevice(net.ParseIP("192.168.2.172").To4())
+	SetProxy(net.ParseIP("10.0.0.5").To4(), nil)
+	AddHostname("tv.local")
+}
+
+func rr(t *testing.T, s string) dns.RR {
+	t.Helper()
+	r, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestMappingRecord(t *testing.T) {
+	testAddrs(t)
+	ActiveProfile = Profile{
+		Ports: map[uint16]uint16{8009: 8010},
+		Txt:   []string{"adminurl"},
+	}
+
+	tests := []struct {
+		name string
+		kind string
+		in   string
+		want string // "" si no cambia
+	}{
+		{"A del dispositivo", MapDeviceToProxy, "tv.local. 120 IN A 192.168.2.172", "tv.local. 120 IN A 10.0.0.5"},
+		{"A de otro", MapDeviceToProxy, "pc.local. 120 IN A 192.168.2.17", ""},
+		{"A del proxy de vuelta", MapProxyToDevice, "tv.local. 120 IN A 10.0.0.5", "tv.local. 120 IN A 192.168.2.172"},
+		{
+			"PTR inverso", MapDeviceToProxy,
+			"172.2.168.192.in-addr.arpa. 120 IN PTR tv.local.",
+			"5.0.0.10.in-addr.arpa. 120 IN PTR tv.local.",
+		},
+		{
+			"SRV remapeado", MapDeviceToProxy,
+			"TV._googlecast._tcp.local. 120 IN SRV 0 0 8009 tv.local.",
+			"TV._googlecast._tcp.local. 120 IN SRV 0 0 8010 tv.local.",
+		},
+		{
+			"SRV de vuelta", MapProxyToDevice,
+			"TV._googlecast._tcp.local. 120 IN SRV 0 0 8010 tv.local.",
+			"TV._googlecast._tcp.local. 120 IN SRV 0 0 8009 tv.local.",
+		},
+		{"SRV sin remapear", MapDeviceToProxy, "TV._googlecast._tcp.local. 120 IN SRV 0 0 8008 tv.local.", ""},
+		{"SRV de otro host", MapDeviceToProxy, "PC._googlecast._tcp.local. 120 IN SRV 0 0 8009 pc.local.", ""},
+		{
+			"TXT con la IP", MapDeviceToProxy,
+			`P._ipp._tcp.local. 120 IN TXT "rp=ipp/print" "adminurl=http://192.168.2.172:631/"`,
+			`P._ipp._tcp.local. 120 IN TXT "rp=ipp/print" "adminurl=http://10.0.0.5:631/"`,
+		},
+		{
+			"TXT con IP más larga", MapDeviceToProxy,
+			`P._ipp._tcp.local. 120 IN TXT "adminurl=http://192.168.2.1720/"`, "",
+		},
+		{
+			"TXT con otra clave", MapDeviceToProxy,
+			`P._ipp._tcp.local. 120 IN TXT "note=192.168.2.172"`, "",
+		},
+	}
+	for _, tt := range tests {
+		in := rr(t, tt.in)
+		orig := in.String()
+		got := newMapping(tt.kind, nil).record(in)
+		if in.String() != orig {
+			t.Errorf("%s: se modificó el registro original: %s", tt.name, in)
+		}
+		if tt.want == "" {
+			if got != nil {
+				t.Errorf("%s: record = %s, se esperaba sin cambios", tt.name, got)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: record = nil, se esperaba %s", tt.name, tt.want)
+			continue
+		}
+		if want := rr(t, tt.want); got.String() != want.String() {
+			t.Errorf("%s: record = %s, se esperaba %s", tt.name, got, want)
+		}
+	}
+}
+
+func TestMappingWithoutDevice(t *testing.T) {
+	testAddrs(t)
+	IpDevice, PtrDevice = nil, ""
+	if m := newMapping(MapDeviceToProxy, nil); m != nil {
+		t.Fatalf("newMapping sin dispositivo = %+v, se esperaba nil", m)
+	}
+	var m *mapping
+	if got := m.record(rr(t, "tv.local. 120 IN A 192.168.2.172")); got != nil {
+		t.Errorf("record con mapping nil = %s", got)
+	}
+}
+
+func TestReplaceIP(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"192.168.2.172", "10.0.0.5"},
+		{"http://192.168.2.172:631/", "http://10.0.0.5:631/"},
+		{"192.168.2.172,192.168.2.172", "10.0.0.5,10.0.0.5"},
+		{"192.168.2.1720", "192.168.2.1720"},
+		{"1192.168.2.172", "1192.168.2.172"},
+		{"192.168.2.172.5", "192.168.2.172.5"},
+		{"sin ip", "sin ip"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := replaceIP(tt.in, "192.168.2.172", "10.0.0.5"); got != tt.want {
+			t.Errorf("replaceIP(%q) = %q, se esperaba %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParsePortRemap(t *testing.T) {
+	tests := []struct {
+		in       string
+		from, to uint16
+		wantErr  bool
+	}{
+		{in: "8009=8010", from: 8009, to: 8010},
+		{in: " 8009 = 8010 ", from: 8009, to: 8010},
+		{in: "8009", wantErr: true},
+		{in: "0=8010", wantErr: true},
+		{in: "8009=70000", wantErr: true},
+		{in: "a=b", wantErr: true},
+	}
+	for _, tt := range tests {
+		from, to, err := ParsePortRemap(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePortRemap(%q): error %v", tt.in, err)
+			continue
+		}
+		if from != tt.from || to != tt.to {
+			t.Errorf("ParsePortRemap(%q) = %d, %d, se esperaba %d, %d", tt.in, from, to, tt.from, tt.to)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package pkg
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// SessionRecord es el resumen de una sesión TCP ya terminada.
+type SessionRecord struct {
+	Listen   string    `json:"listen"`
+	Client   string    `json:"client"`
+	Upstream string    `json:"upstream"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	BytesIn  int64     `json:"bytes_in"` // cliente -> destino
+	BytesOut int64     `json:"bytes_out"`
+	Reason   string    `json:"reason"`
+	TLS      *TLSInfo  `json:"tls,omitempty"`
+}
+
+// TLSInfo son los datos de las dos conexiones TLS del proxy MITM.
+type TLSInfo struct {
+	ServerName   string `json:"server_name,omitempty"` // SNI del cliente
+	ClientVer    string `json:"client_version"`
+	ClientCipher string `json:"client_cipher"`
+	UpstreamVer  string `json:"upstream_version,omitempty"`
+	UpstreamCert string `json:"upstream_cert,omitempty"` // sujeto del certificado del destino
+}
+
+// maxSessions es cuántas sesiones terminadas se guardan en memoria.
+const maxSessions = 500
+
+var (
+	historyMu sync.Mutex
+	history   []SessionRecord
+)
+
+var (
+	sessionSinksMu sync.RWMutex
+	sessionSinks   []func(SessionRecord)
+)
+
+// OnSession registra fn para que reciba el resumen de cada sesión TCP al
+// terminar, también las de los listeners con log=false.
+func OnSession(fn func(SessionRecord)) {
+	sessionSinksMu.Lock()
+	defer sessionSinksMu.Unlock()
+	sessionSinks = append(sessionSinks, fn)
+}
+
+// setReason apunta por qué terminó la sesión si aún no se sabía.
+func (s *tcpSession) setReason(reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+}
+
+// setTLS guarda los datos TLS de la sesión a partir de sus dos conexiones.
+func (s *tcpSession) setTLS(client, upstream *tls.Conn) {
+	info := &TLSInfo{}
+	if client != nil {
+		cs := client.ConnectionState()
+		info.ServerName = cs.ServerName
+		info.ClientVer = tls.VersionName(cs.Version)
+		info.ClientCipher = tls.CipherSuiteName(cs.CipherSuite)
+	}
+	if upstream != nil {
+		cs := upstream.ConnectionState()
+		info.UpstreamVer = tls.VersionName(cs.Version)
+		if len(cs.PeerCertificates) > 0 {
+			info.UpstreamCert = cs.PeerCertificates[0].Subject.String()
+		}
+	}
+	s.mu.Lock()
+	s.tls = info
+	s.mu.Unlock()
+}
+
+// finish da la sesión por terminada: la quita de las activas, la guarda en
+// el historial, se la pasa a los de OnSession y, salvo en los listeners con
+// log=false, emite el evento "session" en el log como JSON. No va al
+// historial de Events: las sesiones son muchas y echarían de él a los avisos
+// (suplantaciones, destinos caídos...).
+func (s *tcpSession) finish(bytesIn, bytesOut int64) {
+	sessions.Lock()
+	delete(sessions.m, s)
+	sessions.Unlock()
+	defer close(s.done)
+	defer s.cancel()
+
+	s.mu.Lock()
+	rec := SessionRecord{
+		Listen:   s.listen,
+		Client:   s.client.RemoteAddr().String(),
+		Start:    s.start,
+		End:      time.Now(),
+		BytesIn:  bytesIn,
+		BytesOut: bytesOut,
+		Reason:   s.reason,
+		TLS:      s.tls,
+	}
+	if s.upstream != nil {
+		rec.Upstream = s.upstream.RemoteAddr().String()
+	}
+	s.mu.Unlock()
+	if rec.Reason == "" {
+		rec.Reason = "desconocido"
+	}
+
+	historyMu.Lock()
+	history = append(history, rec)
+	if len(history) > maxSessions {
+		history = history[len(history)-maxSessions:]
+	}
+	historyMu.Unlock()
+
+	sessionSinksMu.RLock()
+	for _, fn := range sessionSinks {
+		fn(rec)
+	}
+	sessionSinksMu.RUnlock()
+
+	if s.quiet {
+		return
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Error al codificar la sesión: %v", err)
+		return
+	}
+	log.Printf("%s %s", blue("[session]"), b)
+}
+
+// Sessions devuelve una copia del historial de sesiones TCP terminadas, de
+// la más antigua a la más reciente.
+func Sessions() []SessionRecord {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return append([]SessionRecord(nil), history...)
+}
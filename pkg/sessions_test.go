@@ -0,0 +1,46 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFinishEmitsSession(t *testing.T) {
+	var got []SessionRecord
+	OnSession(func(rec SessionRecord) {
+		if rec.Listen == "test:finish" {
+			got = append(got, rec)
+		}
+	})
+
+	for _, quiet := range []bool{false, true} {
+		client, other := net.Pipe()
+		upstream, other2 := net.Pipe()
+		s := trackSession("test:finish", client, quiet)
+		s.setConns(client, upstream)
+		s.setReason("cerrada por el cliente")
+		s.finish(3, 4)
+		client.Close()
+		other.Close()
+		upstream.Close()
+		other2.Close()
+
+		select {
+		case <-s.done:
+		default:
+			t.Fatal("finish no cerró done")
+		}
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("OnSession recibió %d sesiones, se esperaban 2 (también la de log=false)", len(got))
+	}
+	for _, rec := range got {
+		if rec.BytesIn != 3 || rec.BytesOut != 4 || rec.Reason != "cerrada por el cliente" || rec.Upstream == "" {
+			t.Errorf("sesión = %+v", rec)
+		}
+		if rec.End.Before(rec.Start) {
+			t.Errorf("termina (%s) antes de empezar (%s)", rec.End, rec.Start)
+		}
+	}
+}
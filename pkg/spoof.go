@@ -0,0 +1,136 @@
+package pkg
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Qué hacer con los registros del dispositivo que anuncia otro equipo.
+const (
+	SpoofFlag = "flag" // avisar y reenviar igualmente
+	SpoofDrop = "drop" // avisar y descartar esos registros
+)
+
+// SpoofAction es la política ante una suplantación (SpoofFlag o SpoofDrop).
+var SpoofAction = SpoofFlag
+
+// spoofRepeat evita repetir el mismo aviso continuamente.
+const spoofRepeat = 30 * time.Second
+
+var spoof = struct {
+	sync.Mutex
+	hostnames map[string]time.Time // nombres que ha anunciado el dispositivo -> caducidad
+	reported  map[string]time.Time // origen|registro -> último aviso
+}{
+	hostnames: map[string]time.Time{},
+	reported:  map[string]time.Time{},
+}
+
+// checkSpoof comprueba que los registros del dispositivo (su IP o su
+// nombre de host) vengan del propio dispositivo. Los que no, se avisan como
+// evento "spoof" y, con SpoofDrop, se quitan del mensaje. Un nombre de host
+// es del dispositivo mientras dure el TTL con que lo anunció y, si se sigue
+// al dispositivo por nombre, un equipo puede anunciar su propia dirección
+// con él: así se ve el cambio de IP por DHCP. Devuelve el
+// mensaje sin los suplantados, con cualquier política, para los que aprenden
+// de él (dispositivo por nombre, observadores), y cuántos registros se han
+// quitado de msg.
+func checkSpoof(msg *dns.Msg, src *net.UDPAddr, iface string) (*dns.Msg, int) {
+	ipDevice, _ := device()
+	if !msg.Response || src == nil || ipDevice == nil {
+		return msg, 0
+	}
+
+	spoof.Lock()
+	defer spoof.Unlock()
+
+	now := time.Now()
+	for name, t := range spoof.hostnames {
+		if !now.Before(t) {
+			delete(spoof.hostnames, name)
+		}
+	}
+
+	genuine := src.IP.Equal(ipDevice)
+	byNameActive := byName.active()
+	spoofed := 0
+	filter := func(rrs []dns.RR) (keep, clean []dns.RR) {
+		for _, rr := range rrs {
+			name := strings.ToLower(rr.Header().Name)
+			ttl := time.Duration(rr.Header().Ttl) * time.Second
+			claims, own := false, false
+			switch r := rr.(type) {
+			case *dns.A:
+				if r.A.Equal(ipDevice) {
+					if genuine {
+						if ttl > 0 {
+							spoof.hostnames[name] = now.Add(ttl)
+						} else {
+							delete(spoof.hostnames, name)
+						}
+					}
+					claims = true
+				} else {
+					_, claims = spoof.hostnames[name]
+				}
+				own = r.A.Equal(src.IP)
+			case *dns.AAAA:
+				_, claims = spoof.hostnames[name]
+				own = r.AAAA.Equal(src.IP)
+			}
+
+			if !claims || genuine || (own && byNameActive) {
+				keep = append(keep, rr)
+				clean = append(clean, rr)
+				continue
+			}
+			spoofed++
+			reportSpoof(rr, src, iface)
+			if SpoofAction != SpoofDrop {
+				keep = append(keep, rr)
+			}
+		}
+		return keep, clean
+	}
+
+	trusted := *msg
+	msg.Answer, trusted.Answer = filter(msg.Answer)
+	msg.Ns, trusted.Ns = filter(msg.Ns)
+	msg.Extra, trusted.Extra = filter(msg.Extra)
+	if spoofed == 0 {
+		return msg, 0
+	}
+	if SpoofAction == SpoofDrop {
+		return msg, spoofed
+	}
+	return &trusted, 0
+}
+
+// reportSpoof emite el evento, como mucho una vez cada spoofRepeat por
+// origen y registro. Se llama con spoof bloqueado.
+func reportSpoof(rr dns.RR, src *net.UDPAddr, iface string) {
+	key := src.IP.String() + "|" + rrKey(rr)
+	now := time.Now()
+	if t, ok := spoof.reported[key]; ok && now.Sub(t) < spoofRepeat {
+		return
+	}
+	spoof.reported[key] = now
+	for k, t := range spoof.reported {
+		if now.Sub(t) >= spoofRepeat {
+			delete(spoof.reported, k)
+		}
+	}
+
+	ipDevice, _ := device()
+	Emit("spoof", "Otro equipo anuncia registros del dispositivo", map[string]string{
+		"source": src.IP.String(),
+		"device": ipDevice.String(),
+		"record": rr.String(),
+		"iface":  iface,
+		"action": SpoofAction,
+	})
+}
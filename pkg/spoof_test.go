@@ -0,0 +1,185 @@
+package pkg
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// resetSpoof vacía lo aprendido por checkSpoof, ahora y al terminar el test.
+func resetSpoof(t *testing.T) {
+	action := SpoofAction
+	reset := func() {
+		spoof.Lock()
+		spoof.hostnames = map[string]time.Time{}
+		spoof.reported = map[string]time.Time{}
+		spoof.Unlock()
+	}
+	reset()
+	t.Cleanup(func() {
+		SpoofAction = action
+		reset()
+	})
+}
+
+func TestCheckSpoof(t *testing.T) {
+	testAddrs(t)
+	resetSpoof(t)
+
+	device := &net.UDPAddr{IP: net.ParseIP("192.168.2.172"), Port: 5353}
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.2.50"), Port: 5353}
+
+	tests := []struct {
+		name    string
+		action  string
+		src     *net.UDPAddr
+		query   bool
+		records []string
+		left    int // registros que quedan en msg
+		trusted int // registros del mensaje devuelto
+		dropped int
+	}{
+		{
+			name: "del dispositivo", action: SpoofFlag, src: device,
+			records: []string{"tv.local. 120 IN A 192.168.2.172"},
+			left:    1, trusted: 1,
+		},
+		{
+			name: "otro con la IP del dispositivo, flag", action: SpoofFlag, src: other,
+			records: []string{"falso.local. 120 IN A 192.168.2.172", "pc.local. 120 IN A 192.168.2.50"},
+			left:    2, trusted: 1,
+		},
+		{
+			name: "otro con la IP del dispositivo, drop", action: SpoofDrop, src: other,
+			records: []string{"falso.local. 120 IN A 192.168.2.172", "pc.local. 120 IN A 192.168.2.50"},
+			left:    1, trusted: 1, dropped: 1,
+		},
+		{
+			name: "otro con el nombre del dispositivo", action: SpoofDrop, src: other,
+			records: []string{"tv.local. 120 IN A 192.168.2.50", "tv.local. 120 IN AAAA fd00::50"},
+			left:    0, trusted: 0, dropped: 2,
+		},
+		{
+			name: "otro con lo suyo", action: SpoofDrop, src: other,
+			records: []string{"pc.local. 120 IN A 192.168.2.50"},
+			left:    1, trusted: 1,
+		},
+		{
+			name: "pregunta", action: SpoofDrop, src: other, query: true,
+			records: []string{"tv.local. 120 IN A 192.168.2.50"},
+			left:    1, trusted: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		SpoofAction = tt.action
+		msg := new(dns.Msg)
+		msg.Response = !tt.query
+		for _, s := range tt.records {
+			msg.Answer = append(msg.Answer, rr(t, s))
+		}
+		trusted, dropped := checkSpoof(msg, tt.src, "eth1")
+		if len(msg.Answer) != tt.left {
+			t.Errorf("%s: quedan %d registros, se esperaban %d", tt.name, len(msg.Answer), tt.left)
+		}
+		if len(trusted.Answer) != tt.trusted {
+			t.Errorf("%s: el mensaje de confianza tiene %d registros, se esperaban %d", tt.name, len(trusted.Answer), tt.trusted)
+		}
+		if dropped != tt.dropped {
+			t.Errorf("%s: se quitaron %d, se esperaban %d", tt.name, dropped, tt.dropped)
+		}
+	}
+}
+
+func TestCheckSpoofWithoutDevice(t *testing.T) {
+	testAddrs(t)
+	IpDevice, PtrDevice = nil, ""
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{rr(t, "tv.local. 120 IN A 192.168.2.50")}
+	trusted, dropped := checkSpoof(msg, &net.UDPAddr{IP: net.ParseIP("192.168.2.50")}, "eth1")
+	if trusted != msg || dropped != 0 || len(msg.Answer) != 1 {
+		t.Errorf("sin dispositivo checkSpoof cambió el mensaje")
+	}
+}
+
+// spoofMsg es una respuesta con los registros records.
+func spoofMsg(t *testing.T, records ...string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Response = true
+	for _, s := range records {
+		msg.Answer = append(msg.Answer, rr(t, s))
+	}
+	return msg
+}
+
+func TestCheckSpoofExpiresHostnames(t *testing.T) {
+	testAddrs(t)
+	resetSpoof(t)
+	SpoofAction = SpoofDrop
+	device := &net.UDPAddr{IP: net.ParseIP("192.168.2.172"), Port: 5353}
+	other := &net.UDPAddr{IP: net.ParseIP("192.168.2.50"), Port: 5353}
+
+	checkSpoof(spoofMsg(t, "tv.local. 120 IN A 192.168.2.172"), device, "eth1")
+	if _, n := checkSpoof(spoofMsg(t, "tv.local. 120 IN A 192.168.2.50"), other, "eth1"); n != 1 {
+		t.Fatalf("con el nombre vigente se quitaron %d, se esperaba 1", n)
+	}
+
+	// Caducado su TTL, el nombre ya no es del dispositivo.
+	spoof.Lock()
+	spoof.hostnames["tv.local."] = time.Now().Add(-time.Second)
+	spoof.Unlock()
+	if _, n := checkSpoof(spoofMsg(t, "tv.local. 120 IN A 192.168.2.50"), other, "eth1"); n != 0 {
+		t.Errorf("con el nombre caducado se quitaron %d, se esperaba 0", n)
+	}
+
+	// Y una despedida del dispositivo lo olvida en el acto.
+	checkSpoof(spoofMsg(t, "tv.local. 120 IN A 192.168.2.172"), device, "eth1")
+	checkSpoof(spoofMsg(t, "tv.local. 0 IN A 192.168.2.172"), device, "eth1")
+	if _, n := checkSpoof(spoofMsg(t, "tv.local. 120 IN A 192.168.2.50"), other, "eth1"); n != 0 {
+		t.Errorf("tras la despedida se quitaron %d, se esperaba 0", n)
+	}
+}
+
+// El dispositivo buscado por nombre cambia de IP por DHCP: su anuncio desde
+// la nueva dirección no es una suplantación y mueve IpDevice.
+func TestCheckSpoofDeviceAddressChange(t *testing.T) {
+	testAddrs(t)
+	resetSpoof(t)
+	SpoofAction = SpoofDrop
+	saved := byName
+	byName = &devName{
+		target:  map[string]string{},
+		txt:     map[string][]string{},
+		hosts:   map[string]net.IP{},
+		expires: map[string]time.Time{},
+	}
+	t.Cleanup(func() { byName = saved })
+	DeviceByName("TV")
+
+	announce := func(ip string) {
+		t.Helper()
+		msg := spoofMsg(t,
+			"TV._googlecast._tcp.local. 120 IN SRV 0 0 8009 tv.local.",
+			"tv.local. 120 IN A "+ip,
+		)
+		trusted, n := checkSpoof(msg, &net.UDPAddr{IP: net.ParseIP(ip), Port: 5353}, "eth1")
+		if n != 0 || len(trusted.Answer) != 2 {
+			t.Fatalf("anuncio desde %s: se quitaron %d, quedan %d de confianza", ip, n, len(trusted.Answer))
+		}
+		byName.observe(trusted)
+	}
+	announce("192.168.2.172")
+	announce("192.168.2.180")
+	if ip, _ := device(); !ip.Equal(net.ParseIP("192.168.2.180")) {
+		t.Errorf("IpDevice = %s, se esperaba 192.168.2.180", ip)
+	}
+
+	// Otro equipo con una IP que no es la suya sigue siendo suplantación.
+	msg := spoofMsg(t, "tv.local. 120 IN A 192.168.2.99")
+	if _, n := checkSpoof(msg, &net.UDPAddr{IP: net.ParseIP("192.168.2.50"), Port: 5353}, "eth1"); n != 1 {
+		t.Errorf("anuncio ajeno: se quitaron %d, se esperaba 1", n)
+	}
+}
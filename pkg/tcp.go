@@ -1,69 +1,534 @@
 package pkg
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/miekg/dns"
 )
 
-func pipe(a, b net.Conn) {
+// closeWriter lo cumplen *net.TCPConn y *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
 
+// halfClose cierra sólo la escritura de c (envía FIN) para que la otra
+// dirección pueda seguir; si c no lo permite, la cierra entera.
+func halfClose(c net.Conn) {
+	if cw, ok := c.(closeWriter); ok {
+		cw.CloseWrite()
+		return
+	}
+	c.Close()
+}
+
+// pipe copia en ambos sentidos de la sesión s hasta que terminen los dos.
+// Cuando un lado cierra su escritura se le pasa el FIN al otro, sin cortar
+// la respuesta. Al acabar deja la sesión en el historial (ver Sessions). Se
+// corta antes si pasa IdleTimeout sin tráfico o MaxSessionTime.
+func pipe(s *tcpSession, a, b net.Conn) {
+	s.setConns(a, b)
+	var bytesIn, bytesOut int64
+	defer func() { s.finish(bytesIn, bytesOut) }()
 	defer a.Close()
 	defer b.Close()
 
-	errChan := make(chan error, 2)
+	var last atomic.Int64
+	last.Store(time.Now().UnixNano())
+	done := make(chan struct{})
+	defer close(done)
+	go watchTimeouts(s, &last, done)
 
-	go func() {
-		_, err := io.Copy(b, a)
+	errChan := make(chan error, 2)
+	copyHalf := func(dst, src net.Conn, n *int64, closed string) {
+		var err error
+		*n, err = io.Copy(dst, activityReader{src, &last})
+		s.setReason(closeReason(err, closed))
+		if err != nil {
+			// Un error corta las dos direcciones.
+			a.Close()
+			b.Close()
+		} else {
+			halfClose(dst)
+		}
 		errChan <- err
-	}()
+	}
 
-	go func() {
-		_, err := io.Copy(a, b)
-		errChan <- err
-	}()
+	go copyHalf(b, a, &bytesIn, "cerrada por el cliente")
+	go copyHalf(a, b, &bytesOut, "cerrada por el destino")
 
-	err := <-errChan
-	if err != nil && err != io.EOF {
-		log.Printf("Error durante la copia de datos: %v", err)
+	for i := 0; i < 2; i++ {
+		err := <-errChan
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Printf("Error durante la copia de datos: %v", err)
+		}
+	}
+	if !s.quiet {
+		fmt.Println("\033[32mConnection closed.\033[0m") // color green
 	}
-	fmt.Println("\033[32mConnection closed.\033[0m") // color green
 
 }
 
-func Redirect() {
-	ln, err := net.Listen("tcp", "0.0.0.0:8009")
+// portListener es una dirección TCP en la que escucha Redirect.
+type portListener struct {
+	addr        string // dirección de escucha
+	ln          net.Listener
+	upPort      int
+	upstream    func() net.IP // a dónde se reenvía; nil es el dispositivo
+	pool        *upstreamPool // destinos; nil en modo transparente
+	timeout     time.Duration // de la conexión al destino
+	quiet       bool          // no registrar cada conexión
+	proxyIn     []*net.IPNet  // balanceadores que envían la cabecera PROXY
+	proxyOut    int           // versión de la cabecera PROXY al destino; 0 ninguna
+	transparent string        // modo transparente: el destino es el original
+	keepIP      bool          // conectar desde la IP del cliente
+	acl         []ACLRule     // quién puede conectarse (ver ACLs)
+	static      bool          // del perfil o del mapa: no caduca
+	expires     time.Time     // para los que vienen de un SRV
+}
+
+var listeners = struct {
+	sync.Mutex
+	m      map[string]*portListener // dirección de escucha
+	closed bool                     // apagando: no se abren más
+}{m: map[string]*portListener{}}
+
+// dialTimeout es el tiempo para conectar con el destino si no se indica otro.
+const dialTimeout = 10 * time.Second
+
+// Redirect reenvía las conexiones TCP de PortMap o, si está vacío, las de
+// los puertos del perfil activo al dispositivo; en modo transparente (ver
+// Transparent) escucha sólo en TransparentListen y cada conexión va a su
+// destino original. Además reenvía los puertos que anuncie el dispositivo
+// en sus SRV. Cuando se cancela ctx deja de aceptar conexiones y espera a
+// las abiertas (ver DrainTimeout).
+func Redirect(ctx context.Context) error {
+	if len(PortMap) > 0 {
+		for _, pm := range PortMap {
+			var upstreams []func() string
+			for _, a := range pm.Upstreams {
+				upstreams = append(upstreams, fixedAddr(a))
+			}
+			l := &portListener{
+				addr:     pm.Listen,
+				pool:     newPool(pm.Balance, pm.Check, upstreams...),
+				timeout:  pm.Timeout,
+				quiet:    !pm.Log,
+				proxyIn:  pm.ProxyIn,
+				proxyOut: pm.ProxyOut,
+				keepIP:   pm.KeepIP,
+				acl:      pm.ACL,
+				static:   true,
+			}
+			if err := listen(l); err != nil {
+				return fmt.Errorf("error to start listener: %w", err)
+			}
+		}
+	} else if Transparent != "" {
+		l := &portListener{
+			addr:        TransparentListen,
+			proxyIn:     ProxyProtoIn,
+			proxyOut:    ProxyProtoOut,
+			transparent: Transparent,
+			keepIP:      KeepClientIP,
+			static:      true,
+		}
+		if err := listen(l); err != nil {
+			return fmt.Errorf("error to start listener: %w", err)
+		}
+	} else {
+		ports := ActiveProfile.TCP
+		if len(ports) == 0 {
+			ports = []int{8009}
+		}
+		for _, port := range ports {
+			if err := openPort(int(advertisedPort(uint16(port))), 0, nil); err != nil {
+				return fmt.Errorf("error to start listener: %w", err)
+			}
+		}
+	}
+
+	OnPacket(watchSRVPorts)
+	go checkHealth(ctx)
+
+	// Cerramos los puertos cuyo SRV ha caducado.
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			shutdownTCP()
+			return nil
+		case now = <-t.C:
+		}
+		var expired []int
+		listeners.Lock()
+		for addr, l := range listeners.m {
+			if !l.static && now.After(l.expires) {
+				log.Printf("SRV listener %s expired", addr)
+				if tcp, ok := l.ln.Addr().(*net.TCPAddr); ok {
+					expired = append(expired, tcp.Port)
+				}
+				l.ln.Close()
+				delete(listeners.m, addr)
+			}
+		}
+		listeners.Unlock()
+		for _, port := range expired {
+			forgetSRVPort(port)
+		}
+	}
+}
+
+// listen abre l y empieza a aceptar conexiones. Se llama sin listeners
+// bloqueado.
+func listen(l *portListener) error {
+	listeners.Lock()
+	defer listeners.Unlock()
+	return listenLocked(l)
+}
+
+func listenLocked(l *portListener) error {
+	if listeners.closed {
+		return errors.New("apagando")
+	}
+	if _, ok := listeners.m[l.addr]; ok {
+		return fmt.Errorf("ya se escucha en %s", l.addr)
+	}
+	ln, err := listenTCP(l.addr, l.transparent == TransparentTProxy)
 	if err != nil {
-		log.Fatalf("Error to start listener: %v", err)
+		return err
+	}
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok {
+		l.acl = append(l.acl, portACL(tcp.Port)...)
+	}
+	if len(l.proxyIn) > 0 {
+		if err := checkProxyACL(l.acl); err != nil {
+			ln.Close()
+			return fmt.Errorf("%s: %w", l.addr, err)
+		}
+	}
+	l.ln = ln
+	if l.timeout == 0 {
+		l.timeout = dialTimeout
+	}
+	if l.pool == nil && l.transparent == "" {
+		l.pool = devicePool(l)
+	}
+	listeners.m[l.addr] = l
+	log.Printf("Listening on %s", l.addr)
+	go redirectPort(l)
+	return nil
+}
+
+// openPort empieza a escuchar en port en todas las direcciones y reenvía a
+// upstream (nil: al dispositivo). Con ttl 0 el puerto es fijo; si no, se
+// cierra cuando pase ttl sin que se renueve. Si ya se escuchaba en ese
+// puerto, sólo renueva su caducidad (nunca la acorta: puede haber otras
+// instancias en él) y su destino.
+func openPort(port int, ttl time.Duration, upstream func() net.IP) error {
+	listeners.Lock()
+	defer listeners.Unlock()
+
+	if l := findPort(port); l != nil {
+		if !l.static && ttl > 0 {
+			if exp := time.Now().Add(ttl); exp.After(l.expires) {
+				l.expires = exp
+			}
+			if upstream != nil {
+				l.upstream = upstream
+			}
+		}
+		return nil
+	}
+
+	return listenLocked(&portListener{
+		addr:     fmt.Sprintf("0.0.0.0:%d", port),
+		upPort:   devicePort(port),
+		upstream: upstream,
+		proxyIn:  ProxyProtoIn,
+		proxyOut: ProxyProtoOut,
+		keepIP:   KeepClientIP,
+		static:   ttl == 0,
+		expires:  time.Now().Add(ttl),
+	})
+}
+
+// findPort devuelve el listener que ya escucha en port, en cualquier
+// dirección. Se llama con listeners bloqueado.
+func findPort(port int) *portListener {
+	for _, l := range listeners.m {
+		if tcp, ok := l.ln.Addr().(*net.TCPAddr); ok && tcp.Port == port {
+			return l
+		}
+	}
+	return nil
+}
+
+// findListener devuelve el listener que atiende las conexiones a ip:port:
+// el que escucha en esa IP o, si no hay, el que escucha en todas. Varios
+// reenvíos pueden compartir puerto en IPs de proxy distintas. Se llama con
+// listeners bloqueado.
+func findListener(ip net.IP, port int) *portListener {
+	var any *portListener
+	for _, l := range listeners.m {
+		tcp, ok := l.ln.Addr().(*net.TCPAddr)
+		if !ok || tcp.Port != port {
+			continue
+		}
+		if tcp.IP.Equal(ip) {
+			return l
+		}
+		if len(tcp.IP) == 0 || tcp.IP.IsUnspecified() {
+			any = l
+		}
+	}
+	return any
+}
+
+// upstreamAddr devuelve a dónde se reenvían las conexiones de l al
+// dispositivo (o a lo que diga l.upstream), o "" si aún no se sabe.
+func (l *portListener) upstreamAddr() string {
+	listeners.Lock()
+	up := l.upstream
+	listeners.Unlock()
+	var ip net.IP
+	if up != nil {
+		ip = up()
+	} else {
+		ip, _ = device()
+	}
+	if ip == nil {
+		return ""
 	}
-	defer ln.Close()
+	return net.JoinHostPort(ip.String(), strconv.Itoa(l.upPort))
+}
 
-	log.Println("Listening on port 8009")
+// dial conecta con el destino de la conexión c de l: el original en modo
+// transparente o, si no, el primero de sus destinos que conteste. Los que
+// fallan quedan como caídos.
+func (l *portListener) dial(ctx context.Context, c net.Conn) (net.Conn, error) {
+	if l.transparent != "" {
+		upstream, err := transparentTarget(c, l.transparent)
+		if err != nil {
+			return nil, err
+		}
+		return dialUpstream(ctx, upstream, l.timeout, c.RemoteAddr(), l.keepIP)
+	}
+
+	var errs []error
+	for _, u := range l.pool.candidates() {
+		upstream := u.addr()
+		if upstream == "" {
+			errs = append(errs, errNoDevice)
+			continue
+		}
+		up, err := dialUpstream(ctx, upstream, l.timeout, c.RemoteAddr(), l.keepIP)
+		if ctx.Err() != nil {
+			// Cortada mientras conectaba: no es culpa del destino.
+			return nil, ctx.Err()
+		}
+		if err == nil {
+			if !u.isHealthy() {
+				u.setHealth(l.addr, upstream, nil)
+				l.poolChanged()
+			}
+			return up, nil
+		}
+		log.Printf("Could not connect to destination %s: %v", upstream, err)
+		u.setHealth(l.addr, upstream, err)
+		l.poolChanged()
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("ningún destino disponible: %w", errors.Join(errs...))
+}
 
+// closePort deja de escuchar en port si no es un puerto fijo.
+func closePort(port int) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	if l := findPort(port); l != nil && !l.static {
+		log.Printf("Closing %s", l.addr)
+		l.ln.Close()
+		delete(listeners.m, l.addr)
+	}
+}
+
+// srvPorts son las instancias que anuncian cada puerto abierto por un SRV:
+// el puerto sólo se cierra cuando se despide la última.
+var srvPorts = struct {
+	sync.Mutex
+	m map[int]map[string]bool // puerto anunciado -> instancias
+}{m: map[int]map[string]bool{}}
+
+// watchSRVPorts abre un puerto por cada SRV del dispositivo y lo cierra
+// cuando se despiden todas las instancias que lo usan. Sólo cuentan los SRV
+// que llegan del dispositivo por su interfaz.
+func watchSRVPorts(msg *dns.Msg, src *net.UDPAddr, iface string) {
+	ipDevice, _ := device()
+	if !msg.Response || src == nil || !src.IP.Equal(ipDevice) || !fromDevices(src, iface) {
+		return
+	}
+
+	srvPorts.Lock()
+	defer srvPorts.Unlock()
+	for _, sec := range [][]dns.RR{msg.Answer, msg.Extra} {
+		for _, rr := range sec {
+			srv, ok := rr.(*dns.SRV)
+			if !ok {
+				continue
+			}
+			port := int(advertisedPort(srv.Port))
+			inst := strings.ToLower(srv.Hdr.Name)
+			if srv.Hdr.Ttl == 0 {
+				if insts := srvPorts.m[port]; insts[inst] {
+					delete(insts, inst)
+					if len(insts) == 0 {
+						delete(srvPorts.m, port)
+						closePort(port)
+					}
+				}
+				continue
+			}
+			if err := openPort(port, time.Duration(srv.Hdr.Ttl)*time.Second, nil); err != nil {
+				log.Printf("Could not listen on SRV port %d: %v", port, err)
+				continue
+			}
+			if srvPorts.m[port] == nil {
+				srvPorts.m[port] = map[string]bool{}
+			}
+			srvPorts.m[port][inst] = true
+		}
+	}
+}
+
+// forgetSRVPort olvida las instancias de port cuando su listener caduca.
+func forgetSRVPort(port int) {
+	srvPorts.Lock()
+	defer srvPorts.Unlock()
+	delete(srvPorts.m, port)
+}
+
+// redirectPort acepta conexiones en l y reenvía cada una a su destino
+// hasta que se cierre.
+func redirectPort(l *portListener) {
 	for {
-		c, err := ln.Accept()
+		c, err := l.ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Printf("Error to accept connection: %v", err)
 			// if the error is temporary we can continue
 			if ne, ok := err.(net.Error); ok && !ne.Temporary() {
-				log.Fatalf("Critical error on listener: %v", err)
+				log.Printf("Critical error on listener %s: %v", l.addr, err)
+				listeners.Lock()
+				if listeners.m[l.addr] == l {
+					delete(listeners.m, l.addr)
+				}
+				listeners.Unlock()
+				l.ln.Close()
+				return
 			}
 			continue
 		}
-		//color blue
-		fmt.Println("\033[34mNew connection from: ", c.RemoteAddr(), "\033[0m")
+		// Detrás de un balanceador, el cliente (y su IP para la ACL y los
+		// límites) sólo se conoce al leer la cabecera PROXY.
+		behindProxy := len(l.proxyIn) > 0
+		if behindProxy && !trustedProxy(l.proxyIn, remoteIP(c)) {
+			reportReject(c.RemoteAddr(), l.addr, "no es un proxy de confianza")
+			c.Close()
+			continue
+		}
+		var release func()
+		if !behindProxy {
+			if ok, reason := allowed(l.acl, remoteIP(c)); !ok {
+				reportReject(c.RemoteAddr(), l.addr, reason)
+				c.Close()
+				continue
+			}
+			var reason string
+			if release, reason = admit(c); release == nil {
+				reportReject(c.RemoteAddr(), l.addr, reason)
+				c.Close()
+				continue
+			}
+		}
+		if !l.quiet {
+			//color blue
+			fmt.Println("\033[34mNew connection from: ", c.RemoteAddr(), "\033[0m")
+			// Las IPs de los dispositivos virtuales van al mismo dispositivo físico.
+			if local, ok := c.LocalAddr().(*net.TCPAddr); ok {
+				if v := virtualFor(local.IP); v != nil {
+					log.Printf("Connection to virtual device %q (%s)", v.Name, local.IP)
+				}
+			}
+		}
 
-		go func(clientConn net.Conn) {
-			// with timeout 10 seconds for avoiding long blocking
-			up, err := net.DialTimeout("tcp", IpDevice.String()+":8009", 10*time.Second)
+		// La sesión cuenta (y se drena al apagar) desde que se acepta.
+		s := trackSession(l.addr, c, l.quiet)
+		go func(clientConn net.Conn, release func()) {
+			defer func() {
+				if release != nil {
+					release()
+				}
+			}()
+			if behindProxy {
+				pc, err := readProxyHeader(clientConn)
+				if err != nil {
+					log.Printf("Cabecera PROXY no válida de %s: %v", clientConn.RemoteAddr(), err)
+					s.abort("cabecera PROXY no válida")
+					return
+				}
+				clientConn = pc
+				s.setConns(pc, nil)
+				if ok, reason := allowed(l.acl, remoteIP(pc)); !ok {
+					reportReject(pc.RemoteAddr(), l.addr, reason)
+					s.abort(reason)
+					return
+				}
+				var reason string
+				if release, reason = admit(pc); release == nil {
+					reportReject(pc.RemoteAddr(), l.addr, reason)
+					s.abort(reason)
+					return
+				}
+			}
+			// En modo transparente valen también las reglas del puerto original.
+			if l.transparent != "" {
+				if dst, err := originalDst(clientConn, l.transparent); err == nil {
+					if ok, reason := allowed(portACL(dst.Port), remoteIP(clientConn)); !ok {
+						reportReject(clientConn.RemoteAddr(), dst.String(), reason)
+						s.abort(reason)
+						return
+					}
+				}
+			}
+			up, err := l.dial(s.ctx, clientConn)
 			if err != nil {
-				log.Printf("Could not connect to destination %s: %v", IpDevice, err)
-				clientConn.Close()
+				log.Printf("No destination for %s: %v", clientConn.RemoteAddr(), err)
+				s.abort("sin destino: " + err.Error())
 				return
 			}
-			pipe(clientConn, up)
-		}(c)
+			s.setConns(clientConn, up)
+			if l.proxyOut != 0 {
+				if err := writeProxyHeader(up, l.proxyOut, clientConn.RemoteAddr(), clientConn.LocalAddr()); err != nil {
+					log.Printf("Could not send PROXY header to %s: %v", up.RemoteAddr(), err)
+					s.abort("cabecera PROXY: " + err.Error())
+					return
+				}
+			}
+			pipe(s, clientConn, up)
+		}(c, release)
 	}
 }
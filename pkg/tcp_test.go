@@ -0,0 +1,163 @@
+package pkg
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// upstreamServer escucha en loopback y pasa cada conexión a handle.
+func upstreamServer(t *testing.T, handle func(net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				handle(c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startListener abre l en loopback como lo haría Redirect y devuelve su
+// dirección.
+func startListener(t *testing.T, l *portListener) string {
+	t.Helper()
+	l.addr = "127.0.0.1:0"
+	l.static = true
+	if err := listen(l); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		listeners.Lock()
+		delete(listeners.m, l.addr)
+		listeners.Unlock()
+		l.ln.Close()
+	})
+	return l.ln.Addr().String()
+}
+
+func mustRule(t *testing.T, s string) ACLRule {
+	t.Helper()
+	r, err := ParseACLRule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// Detrás de un balanceador, la ACL se aplica a la IP del cliente que trae
+// la cabecera PROXY, no a la del balanceador.
+func TestRedirectACLBehindProxy(t *testing.T) {
+	up := upstreamServer(t, func(c net.Conn) { io.WriteString(c, "hola") })
+	_, lo, _ := net.ParseCIDR("127.0.0.0/8")
+	addr := startListener(t, &portListener{
+		pool:    newPool("", CheckNone, fixedAddr(up)),
+		proxyIn: []*net.IPNet{lo},
+		acl:     []ACLRule{mustRule(t, "allow:192.168.1.0/24")},
+	})
+
+	tests := []struct {
+		client string
+		want   string
+	}{
+		{"192.168.1.10", "hola"},
+		{"10.9.9.9", ""},
+	}
+	for _, tt := range tests {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src := &net.TCPAddr{IP: net.ParseIP(tt.client), Port: 40000}
+		dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.5"), Port: 8009}
+		if err := writeProxyHeader(c, 1, src, dst); err != nil {
+			t.Fatal(err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		got, err := io.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Errorf("cliente %s: %v", tt.client, err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("cliente %s: se leyó %q, se esperaba %q", tt.client, got, tt.want)
+		}
+	}
+}
+
+func TestProxyInRejectsNeighborRules(t *testing.T) {
+	_, lo, _ := net.ParseCIDR("127.0.0.0/8")
+	for _, rule := range []string{"allow:mac=aa:bb:cc:dd:ee:ff", "deny:iface=eth1"} {
+		l := &portListener{addr: "127.0.0.1:0", proxyIn: []*net.IPNet{lo}, acl: []ACLRule{mustRule(t, rule)}}
+		if err := listen(l); err == nil {
+			l.ln.Close()
+			listeners.Lock()
+			delete(listeners.m, l.addr)
+			listeners.Unlock()
+			t.Errorf("listener con proxy-in y %q: se esperaba error", rule)
+		}
+	}
+}
+
+// Un cliente que cierra su escritura (FIN) sigue recibiendo la respuesta:
+// el destino ve el fin de la petición y contesta después.
+func TestRedirectHalfClose(t *testing.T) {
+	up := upstreamServer(t, func(c net.Conn) {
+		req, _ := io.ReadAll(c)
+		io.WriteString(c, "recibido: "+string(req))
+	})
+	_, lo, _ := net.ParseCIDR("127.0.0.0/8")
+
+	tests := []struct {
+		name    string
+		proxyIn []*net.IPNet
+	}{
+		{"directo", nil},
+		{"con cabecera PROXY", []*net.IPNet{lo}},
+	}
+	for _, tt := range tests {
+		// Cada caso en su subtest: el listener se cierra (y deja libre
+		// 127.0.0.1:0 en listeners) al acabar el caso.
+		t.Run(tt.name, func(t *testing.T) {
+			addr := startListener(t, &portListener{
+				pool:    newPool("", CheckNone, fixedAddr(up)),
+				proxyIn: tt.proxyIn,
+			})
+			c, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.proxyIn != nil {
+				src := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 40000}
+				if err := writeProxyHeader(c, 2, src, c.RemoteAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			io.WriteString(c, "hola")
+			if err := c.(*net.TCPConn).CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got, err := io.ReadAll(c)
+			c.Close()
+			if err != nil {
+				t.Error(err)
+			}
+			if string(got) != "recibido: hola" {
+				t.Errorf("se leyó %q tras CloseWrite, se esperaba %q", got, "recibido: hola")
+			}
+		})
+	}
+}
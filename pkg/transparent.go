@@ -0,0 +1,257 @@
+package pkg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Modos del proxy transparente. Con REDIRECT las conexiones llegan a
+// nuestro puerto y el destino original se lee con SO_ORIGINAL_DST; con
+// TPROXY llegan sin tocar y el destino original es la dirección local.
+const (
+	TransparentRedirect = "redirect"
+	TransparentTProxy   = "tproxy"
+)
+
+// Transparent es el modo transparente; vacío lo desactiva.
+var Transparent string
+
+// TransparentListen es donde escucha el proxy transparente. Un solo puerto
+// atiende a todos los dispositivos y puertos que desvíe iptables.
+var TransparentListen = "0.0.0.0:15001"
+
+// KeepClientIP hace que las conexiones al destino salgan con la IP del
+// cliente (IP_TRANSPARENT) en lugar de la del proxy. El dispositivo tiene
+// que encaminar las respuestas a los clientes a través del proxy (p. ej.
+// teniéndolo de puerta de enlace); aquí se marcan con AddSourceMark y
+// AddLocalRouting las entrega al socket.
+var KeepClientIP bool
+
+// Marca y tabla de rutas con las que TPROXY (y las respuestas a conexiones
+// con IP del cliente) entrega los paquetes desviados al propio equipo.
+const (
+	tproxyMark  = 0x1
+	tproxyTable = 100
+)
+
+// listenTCP escucha en addr con los KeepAlive indicados; con tproxy activa
+// IP_TRANSPARENT para poder aceptar conexiones a direcciones que no son
+// nuestras.
+func listenTCP(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAliveConfig: KeepAlive}
+	if tproxy {
+		lc.Control = setTransparent
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// dialUpstream conecta con addr; con keepIP sale desde la IP de client. Se
+// abandona si se cancela ctx.
+func dialUpstream(ctx context.Context, addr string, timeout time.Duration, client net.Addr, keepIP bool) (net.Conn, error) {
+	return upstreamDialer(timeout, client, keepIP).DialContext(ctx, "tcp", addr)
+}
+
+// upstreamDialer es el Dialer hacia el destino. Con keepIP y un cliente
+// IPv4 se enlaza a la IP del cliente, con un puerto cualquiera para no
+// chocar con el suyo.
+func upstreamDialer(timeout time.Duration, client net.Addr, keepIP bool) *net.Dialer {
+	d := &net.Dialer{Timeout: timeout, KeepAliveConfig: KeepAlive}
+	c, ok := client.(*net.TCPAddr)
+	if !keepIP || !ok || c.IP.To4() == nil {
+		return d
+	}
+	d.LocalAddr = &net.TCPAddr{IP: c.IP.To4()}
+	d.Control = setTransparent
+	return d
+}
+
+// setTransparent activa IP_TRANSPARENT en el socket, que permite escuchar
+// en y conectar desde direcciones que no son nuestras.
+func setTransparent(network, address string, c syscall.RawConn) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// originalDst devuelve a dónde se conectaba el cliente antes de que
+// iptables desviara c. Se mira siempre el socket: el destino de una
+// cabecera PROXY no se usa, ya que dejaría al cliente conectar a cualquier
+// sitio a través del proxy.
+func originalDst(c net.Conn, mode string) (*net.TCPAddr, error) {
+	c = socketConn(c)
+	if mode == TransparentTProxy {
+		a, ok := c.LocalAddr().(*net.TCPAddr)
+		if !ok {
+			return nil, errors.New("no es una conexión TCP")
+		}
+		return a, nil
+	}
+
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("no es una conexión TCP")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	// SO_ORIGINAL_DST devuelve una sockaddr_in; GetsockoptIPv6Mreq es el
+	// getsockopt de 16 bytes que tiene x/sys.
+	var mreq *unix.IPv6Mreq
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SO_ORIGINAL_DST: %w", err)
+	}
+	sa := mreq.Multiaddr
+	return &net.TCPAddr{
+		IP:   net.IPv4(sa[4], sa[5], sa[6], sa[7]),
+		Port: int(binary.BigEndian.Uint16(sa[2:4])),
+	}, nil
+}
+
+// socketConn es la conexión de c sin la cabecera PROXY, con las
+// direcciones del socket.
+func socketConn(c net.Conn) net.Conn {
+	if pc, ok := c.(*proxyConn); ok {
+		return pc.Conn
+	}
+	return c
+}
+
+// transparentTarget es a dónde se reenvía la conexión c del proxy
+// transparente: su destino original o, si era una IP nuestra (la que
+// anuncia el mDNS reescrito), el dispositivo.
+func transparentTarget(c net.Conn, mode string) (string, error) {
+	dst, err := originalDst(c, mode)
+	if err != nil {
+		return "", err
+	}
+	if !isLocalIP(dst.IP) {
+		return dst.String(), nil
+	}
+	if ln, ok := socketConn(c).LocalAddr().(*net.TCPAddr); ok && mode == TransparentRedirect && dst.Port == ln.Port {
+		// No la desvió iptables: se conectaron directamente a nuestro puerto.
+		return "", fmt.Errorf("conexión directa a %s", dst)
+	}
+	ipDevice, _ := device()
+	if ipDevice == nil {
+		return "", errNoDevice
+	}
+	return net.JoinHostPort(ipDevice.String(), strconv.Itoa(devicePort(dst.Port))), nil
+}
+
+// isLocalIP indica si ip es una dirección de este equipo.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalRouting es la regla de encaminamiento por marca que hace falta con
+// TPROXY: los paquetes marcados se buscan en una tabla que lo entrega todo
+// al propio equipo.
+type LocalRouting struct {
+	rule, route bool // lo que añadimos nosotros, para quitarlo al salir
+}
+
+// AddLocalRouting añade "ip rule add fwmark 1/1 lookup 100" y
+// "ip route add local 0.0.0.0/0 dev lo table 100". Si ya estaban, los deja.
+func AddLocalRouting() (*LocalRouting, error) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		return nil, err
+	}
+	r := &LocalRouting{}
+
+	err = nlRequest(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ruleMsg())
+	switch {
+	case err == nil:
+		r.rule = true
+	case !errors.Is(err, unix.EEXIST):
+		return nil, fmt.Errorf("no se pudo añadir la regla de la marca %#x: %w", tproxyMark, err)
+	}
+
+	err = nlRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, localRouteMsg(lo.Index))
+	switch {
+	case err == nil:
+		r.route = true
+	case !errors.Is(err, unix.EEXIST):
+		r.Remove()
+		return nil, fmt.Errorf("no se pudo añadir la ruta local de la tabla %d: %w", tproxyTable, err)
+	}
+	log.Printf("Encaminamiento local de la marca %#x por la tabla %d", tproxyMark, tproxyTable)
+	return r, nil
+}
+
+// Remove quita lo que añadió AddLocalRouting.
+func (r *LocalRouting) Remove() {
+	if r.route {
+		if lo, err := net.InterfaceByName("lo"); err == nil {
+			if err := nlRequest(unix.RTM_DELROUTE, 0, localRouteMsg(lo.Index)); err != nil {
+				log.Printf("No se pudo quitar la ruta local de la tabla %d: %v", tproxyTable, err)
+			}
+		}
+		r.route = false
+	}
+	if r.rule {
+		if err := nlRequest(unix.RTM_DELRULE, 0, ruleMsg()); err != nil {
+			log.Printf("No se pudo quitar la regla de la marca %#x: %v", tproxyMark, err)
+		}
+		r.rule = false
+	}
+}
+
+// ruleMsg es la fib_rule_hdr de la regla "fwmark tproxyMark lookup tproxyTable".
+func ruleMsg() []byte {
+	u32 := func(v uint32) []byte { return binary.NativeEndian.AppendUint32(nil, v) }
+	body := make([]byte, 12)
+	body[0] = unix.AF_INET
+	body[7] = unix.FR_ACT_TO_TBL
+	body = append(body, nlAttr(unix.FRA_FWMARK, u32(tproxyMark))...)
+	body = append(body, nlAttr(unix.FRA_FWMASK, u32(tproxyMark))...)
+	body = append(body, nlAttr(unix.FRA_TABLE, u32(tproxyTable))...)
+	return body
+}
+
+// localRouteMsg es la rtmsg de "local 0.0.0.0/0 dev lo table tproxyTable".
+func localRouteMsg(lo int) []byte {
+	u32 := func(v uint32) []byte { return binary.NativeEndian.AppendUint32(nil, v) }
+	body := make([]byte, unix.SizeofRtMsg)
+	body[0] = unix.AF_INET
+	body[5] = unix.RTPROT_BOOT
+	body[6] = unix.RT_SCOPE_HOST
+	body[7] = unix.RTN_LOCAL
+	body = append(body, nlAttr(unix.RTA_TABLE, u32(tproxyTable))...)
+	body = append(body, nlAttr(unix.RTA_OIF, u32(uint32(lo)))...)
+	return body
+}
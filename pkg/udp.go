@@ -0,0 +1,307 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDPIdle es cuánto vive una sesión UDP sin tráfico.
+var UDPIdle = 2 * time.Minute
+
+// UDPPorts son puertos UDP que se reenvían además de los del perfil (p. ej.
+// los de RTP de la duplicación de pantalla de Cast, que el perfil no fija).
+var UDPPorts []int
+
+// UDPMaxSessions es el máximo de sesiones abiertas a la vez en cada relé;
+// 0 es sin límite.
+var UDPMaxSessions = 256
+
+// ParseUDPPorts lee un puerto o un rango ("5000" o "32768-32800").
+func ParseUDPPorts(s string) ([]int, error) {
+	lo, hi, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	if !isRange {
+		hi = lo
+	}
+	a, err1 := strconv.ParseUint(lo, 10, 16)
+	b, err2 := strconv.ParseUint(hi, 10, 16)
+	if err1 != nil || err2 != nil || a == 0 || b < a {
+		return nil, fmt.Errorf("puertos UDP no válidos %q", s)
+	}
+	if b-a >= 1024 {
+		return nil, fmt.Errorf("rango UDP demasiado grande %q", s)
+	}
+	var ports []int
+	for p := a; p <= b; p++ {
+		ports = append(ports, int(p))
+	}
+	return ports, nil
+}
+
+// UDPRelay reenvía datagramas UDP al dispositivo. Cada cliente (IP y
+// puerto) tiene su propia sesión, con un socket propio hacia el destino,
+// como una traducción NAT; las respuestas vuelven al cliente por ella.
+type UDPRelay struct {
+	Listen string
+	port   int
+	ln     *net.UDPConn
+	done   chan struct{}
+
+	mu       sync.Mutex
+	sessions map[string]*udpSession // dirección del cliente
+}
+
+type udpSession struct {
+	client   *net.UDPAddr
+	upstream *net.UDPConn
+	created  time.Time
+	lastSeen atomic.Int64 // unix nano
+
+	bytesIn, bytesOut     atomic.Uint64 // in: cliente -> destino
+	packetsIn, packetsOut atomic.Uint64
+}
+
+// UDPSessionStats son los contadores de una sesión UDP.
+type UDPSessionStats struct {
+	Listen     string    `json:"listen"`
+	Client     string    `json:"client"`
+	Upstream   string    `json:"upstream"`
+	Created    time.Time `json:"created"`
+	LastSeen   time.Time `json:"last_seen"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	PacketsIn  uint64    `json:"packets_in"`
+	PacketsOut uint64    `json:"packets_out"`
+}
+
+var udpRelays = struct {
+	sync.Mutex
+	list []*UDPRelay
+}{}
+
+// RelayUDP abre un relé por cada puerto UDP del perfil activo y de
+// UDPPorts y los cierra cuando se cancela ctx.
+func RelayUDP(ctx context.Context) {
+	var wg sync.WaitGroup
+	var relays []*UDPRelay
+	for _, port := range appendUnique(append([]int(nil), ActiveProfile.UDP...), UDPPorts...) {
+		port := advertisedPort(uint16(port))
+		r, err := NewUDPRelay(fmt.Sprintf("0.0.0.0:%d", port))
+		if err != nil {
+			log.Printf("Error al abrir el relé UDP en %d: %v", port, err)
+			continue
+		}
+		relays = append(relays, r)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.Run()
+		}()
+	}
+
+	<-ctx.Done()
+	for _, r := range relays {
+		r.Close()
+	}
+	wg.Wait()
+}
+
+// NewUDPRelay escucha en listen y reenvía al mismo puerto del dispositivo.
+func NewUDPRelay(listen string) (*UDPRelay, error) {
+	addr, err := net.ResolveUDPAddr("udp4", listen)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &UDPRelay{Listen: listen, port: addr.Port, ln: ln, done: make(chan struct{}), sessions: map[string]*udpSession{}}
+
+	udpRelays.Lock()
+	udpRelays.list = append(udpRelays.list, r)
+	udpRelays.Unlock()
+	log.Printf("Relé UDP escuchando en %s", listen)
+	return r, nil
+}
+
+// Run reenvía datagramas hasta que se cierre el relé.
+func (r *UDPRelay) Run() {
+	go r.expire()
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := r.ln.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error al leer del relé UDP %s: %v", r.Listen, err)
+			continue
+		}
+
+		if !r.has(client) {
+			if ok, reason := allowed(portACL(r.port), client.IP); !ok {
+				reportReject(client, r.Listen, reason)
+				continue
+			}
+		}
+		s, err := r.session(client)
+		if err != nil {
+			reportReject(client, r.Listen, err.Error())
+			continue
+		}
+		if _, err := s.upstream.Write(buf[:n]); err != nil {
+			log.Printf("Error al enviar a %s: %v", s.upstream.RemoteAddr(), err)
+			continue
+		}
+		s.lastSeen.Store(time.Now().UnixNano())
+		s.bytesIn.Add(uint64(n))
+		s.packetsIn.Add(1)
+	}
+}
+
+// Close cierra el relé y todas sus sesiones.
+func (r *UDPRelay) Close() {
+	r.ln.Close()
+	close(r.done)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k, s := range r.sessions {
+		s.upstream.Close()
+		delete(r.sessions, k)
+	}
+}
+
+// has indica si el cliente ya tiene sesión.
+func (r *UDPRelay) has(client *net.UDPAddr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, ok := r.sessions[client.String()]
+	return ok
+}
+
+// session devuelve (creándola) la sesión del cliente.
+func (r *UDPRelay) session(client *net.UDPAddr) (*udpSession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := client.String()
+	if s, ok := r.sessions[key]; ok {
+		return s, nil
+	}
+
+	if UDPMaxSessions > 0 && len(r.sessions) >= UDPMaxSessions {
+		return nil, fmt.Errorf("límite de %d sesiones UDP", UDPMaxSessions)
+	}
+	ipDevice, _ := device()
+	if ipDevice == nil {
+		return nil, errNoDevice
+	}
+	up, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ipDevice, Port: devicePort(r.port)})
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSession{client: client, upstream: up, created: time.Now()}
+	s.lastSeen.Store(s.created.UnixNano())
+	r.sessions[key] = s
+	log.Printf("Nueva sesión UDP %s -> %s", client, up.RemoteAddr())
+
+	go r.replies(s)
+	return s, nil
+}
+
+// replies devuelve al cliente lo que responda el destino.
+func (r *UDPRelay) replies(s *udpSession) {
+	buf := make([]byte, 65535)
+	for {
+		n, err := s.upstream.Read(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("Error en la sesión UDP %s: %v", s.client, err)
+				r.drop(s)
+			}
+			return
+		}
+		if _, err := r.ln.WriteToUDP(buf[:n], s.client); err != nil {
+			log.Printf("Error al responder a %s: %v", s.client, err)
+			continue
+		}
+		s.lastSeen.Store(time.Now().UnixNano())
+		s.bytesOut.Add(uint64(n))
+		s.packetsOut.Add(1)
+	}
+}
+
+// expire cierra las sesiones inactivas más de UDPIdle.
+func (r *UDPRelay) expire() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-t.C:
+		}
+		cutoff := time.Now().Add(-UDPIdle).UnixNano()
+		r.mu.Lock()
+		for k, s := range r.sessions {
+			if s.lastSeen.Load() < cutoff {
+				log.Printf("Sesión UDP %s caducada (%d/%d bytes)", s.client, s.bytesIn.Load(), s.bytesOut.Load())
+				s.upstream.Close()
+				delete(r.sessions, k)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *UDPRelay) drop(s *udpSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.sessions[s.client.String()] == s {
+		delete(r.sessions, s.client.String())
+	}
+	s.upstream.Close()
+}
+
+// UDPSessions devuelve los contadores de todas las sesiones UDP abiertas.
+func UDPSessions() []UDPSessionStats {
+	udpRelays.Lock()
+	relays := append([]*UDPRelay(nil), udpRelays.list...)
+	udpRelays.Unlock()
+
+	var out []UDPSessionStats
+	for _, r := range relays {
+		r.mu.Lock()
+		for _, s := range r.sessions {
+			out = append(out, UDPSessionStats{
+				Listen:     r.Listen,
+				Client:     s.client.String(),
+				Upstream:   s.upstream.RemoteAddr().String(),
+				Created:    s.created,
+				LastSeen:   time.Unix(0, s.lastSeen.Load()),
+				BytesIn:    s.bytesIn.Load(),
+				BytesOut:   s.bytesOut.Load(),
+				PacketsIn:  s.packetsIn.Load(),
+				PacketsOut: s.packetsOut.Load(),
+			})
+		}
+		r.mu.Unlock()
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Listen != out[j].Listen {
+			return out[i].Listen < out[j].Listen
+		}
+		return out[i].Client < out[j].Client
+	})
+	return out
+}
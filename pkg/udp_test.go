@@ -0,0 +1,111 @@
+package pkg
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseUDPPorts(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{in: "5000", want: []int{5000}},
+		{in: "32768-32770", want: []int{32768, 32769, 32770}},
+		{in: "0", wantErr: true},
+		{in: "70000", wantErr: true},
+		{in: "5001-5000", wantErr: true},
+		{in: "1-2000", wantErr: true},
+		{in: "rtp", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseUDPPorts(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseUDPPorts(%q) = %v, se esperaba error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseUDPPorts(%q) = %v, %v, se esperaba %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+// Cada cliente tiene su sesión: la respuesta del destino vuelve a quien
+// envió, y los contadores son por cliente.
+func TestUDPRelay(t *testing.T) {
+	testAddrs(t)
+	ActiveProfile = Profile{}
+
+	// El "dispositivo" es un eco en 127.0.0.1; el relé escucha en el mismo
+	// puerto de 127.0.0.2.
+	up, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { up.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := up.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			up.WriteToUDP(append([]byte("eco: "), buf[:n]...), from)
+		}
+	}()
+	SetDevice(net.IPv4(127, 0, 0, 1).To4())
+	port := up.LocalAddr().(*net.UDPAddr).Port
+
+	r, err := NewUDPRelay((&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: port}).String())
+	if err != nil {
+		t.Skipf("no se puede escuchar en 127.0.0.2: %v", err)
+	}
+	go r.Run()
+	t.Cleanup(func() {
+		r.Close()
+		udpRelays.Lock()
+		udpRelays.list = nil
+		udpRelays.Unlock()
+	})
+
+	for _, msg := range []string{"uno", "dos"} {
+		c, err := net.DialUDP("udp4", nil, r.ln.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte(msg))
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", msg, err)
+		}
+		if got, want := string(buf[:n]), "eco: "+msg; got != want {
+			t.Errorf("se recibió %q, se esperaba %q", got, want)
+		}
+	}
+
+	// Los contadores se suman después de reenviar: se espera a que cuadren.
+	var stats []UDPSessionStats
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		stats = UDPSessions()
+		if len(stats) == 2 && stats[0].PacketsOut == 1 && stats[1].PacketsOut == 1 {
+			break
+		}
+	}
+	if len(stats) != 2 {
+		t.Fatalf("hay %d sesiones, se esperaban 2: %+v", len(stats), stats)
+	}
+	for _, s := range stats {
+		if s.PacketsIn != 1 || s.PacketsOut != 1 || s.BytesIn != 3 || s.BytesOut != 8 {
+			t.Errorf("sesión %s: in %d/%d out %d/%d, se esperaba in 1/3 out 1/8",
+				s.Client, s.PacketsIn, s.BytesIn, s.PacketsOut, s.BytesOut)
+		}
+	}
+}
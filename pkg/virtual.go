@@ -0,0 +1,266 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// VirtualDevice es una copia del dispositivo físico que se anuncia con
+// otro nombre, otra IP de proxy y otra identidad en el TXT.
+type VirtualDevice struct {
+	Name  string // nombre de instancia (y fn= del TXT)
+	Proxy net.IP
+	ID    string // id= del TXT; vacío deriva uno del original y de Name
+}
+
+// VirtualDevices son los dispositivos virtuales a anunciar.
+var VirtualDevices []VirtualDevice
+
+// ParseVirtualDevice lee "IP,NOMBRE[,ID]".
+func ParseVirtualDevice(s string) (VirtualDevice, error) {
+	parts := strings.SplitN(s, ",", 3)
+	if len(parts) < 2 || strings.TrimSpace(parts[1]) == "" {
+		return VirtualDevice{}, fmt.Errorf("formato IP,NOMBRE[,ID]: %q", s)
+	}
+	ip := net.ParseIP(strings.TrimSpace(parts[0])).To4()
+	if ip == nil {
+		return VirtualDevice{}, fmt.Errorf("IP no válida %q", parts[0])
+	}
+	v := VirtualDevice{Name: strings.TrimSpace(parts[1]), Proxy: ip}
+	if len(parts) == 3 {
+		v.ID = strings.TrimSpace(parts[2])
+	}
+	return v, nil
+}
+
+// id es el id= del TXT del dispositivo virtual cuando el del físico es
+// real. Sin ID propio se deriva de real y del nombre: estable entre
+// reinicios y distinto en cada copia, para que los clientes (que agrupan
+// por id) no las tomen por un solo dispositivo.
+func (v *VirtualDevice) id(real string) string {
+	if v.ID != "" {
+		return v.ID
+	}
+	sum := sha256.Sum256([]byte(real + "|" + v.Name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// host es el nombre de host .local del dispositivo virtual.
+func (v *VirtualDevice) host() string {
+	var b strings.Builder
+	for _, c := range strings.ToLower(v.Name) {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('-')
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// virtualNames traduce los nombres virtuales que hemos anunciado a los del
+// dispositivo físico, para reescribir las preguntas de los clientes.
+var virtualNames = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// fanOut añade a la respuesta del dispositivo una copia de sus registros
+// por cada dispositivo virtual.
+func fanOut(msg *dns.Msg, src *net.UDPAddr) {
+	ipDevice, ptrDevice := device()
+	if len(VirtualDevices) == 0 || !msg.Response || src == nil || !src.IP.Equal(ipDevice) {
+		return
+	}
+
+	// Instancias y hosts del dispositivo que aparecen en el mensaje.
+	instances := map[string]bool{}
+	hosts := map[string]bool{}
+	all := append(append(append([]dns.RR(nil), msg.Answer...), msg.Ns...), msg.Extra...)
+	for _, rr := range all {
+		name := strings.ToLower(rr.Header().Name)
+		switch r := rr.(type) {
+		case *dns.SRV:
+			instances[name] = true
+			hosts[strings.ToLower(r.Target)] = true
+		case *dns.TXT:
+			if isInstance(name) {
+				instances[name] = true
+			}
+		case *dns.PTR:
+			if strings.HasPrefix(name, "_") && !strings.HasPrefix(name, "_services.") {
+				instances[strings.ToLower(r.Ptr)] = true
+			}
+		case *dns.A:
+			if r.A.Equal(ipDevice) {
+				hosts[name] = true
+			}
+		}
+	}
+	if len(instances) == 0 && len(hosts) == 0 {
+		return
+	}
+
+	virtualNames.Lock()
+	defer virtualNames.Unlock()
+	for i := range VirtualDevices {
+		v := &VirtualDevices[i]
+		rename := func(name string) string {
+			lname := strings.ToLower(name)
+			var out string
+			switch {
+			case instances[lname]:
+				out = escapeLabel(v.Name) + lname[labelEnd(lname):]
+			case hosts[lname]:
+				out = v.host() + lname[labelEnd(lname):]
+			default:
+				return name
+			}
+			virtualNames.m[strings.ToLower(out)] = lname
+			return out
+		}
+		clone := func(rrs []dns.RR) []dns.RR {
+			var out []dns.RR
+			for _, rr := range rrs {
+				if c := v.record(rr, rename, ipDevice, ptrDevice); c != nil {
+					out = append(out, c)
+				}
+			}
+			return out
+		}
+		msg.Answer = append(msg.Answer, clone(msg.Answer)...)
+		msg.Extra = append(msg.Extra, clone(msg.Extra)...)
+	}
+}
+
+// record devuelve la copia virtual de rr, o nil si rr no es del dispositivo.
+func (v *VirtualDevice) record(rr dns.RR, rename func(string) string, ipDevice net.IP, ptrDevice string) dns.RR {
+	c := dns.Copy(rr)
+	h := c.Header()
+	switch r := c.(type) {
+	case *dns.PTR:
+		if h.Name == ptrDevice {
+			h.Name = IpToPtr(v.Proxy)
+			r.Ptr = rename(r.Ptr)
+			return c
+		}
+		if n := rename(r.Ptr); n != r.Ptr {
+			r.Ptr = n
+			return c
+		}
+	case *dns.SRV:
+		if n := rename(h.Name); n != h.Name {
+			h.Name = n
+			r.Target = rename(r.Target)
+			// El host virtual no es del dispositivo y la reescritura no lo
+			// toca: el puerto anunciado se pone aquí.
+			r.Port = advertisedPort(r.Port)
+			return c
+		}
+	case *dns.TXT:
+		if n := rename(h.Name); n != h.Name {
+			h.Name = n
+			for i, kv := range r.Txt {
+				k, val, _ := strings.Cut(kv, "=")
+				switch k {
+				case "fn":
+					r.Txt[i] = "fn=" + v.Name
+				case "id":
+					r.Txt[i] = "id=" + v.id(val)
+				}
+			}
+			return c
+		}
+	case *dns.A:
+		if r.A.Equal(ipDevice) {
+			h.Name = rename(h.Name)
+			r.A = v.Proxy
+			return c
+		}
+	}
+	return nil
+}
+
+// unvirtualize traduce en las preguntas de los clientes los nombres y PTR
+// virtuales a los del dispositivo físico.
+func unvirtualize(msg *dns.Msg) {
+	if len(VirtualDevices) == 0 || msg.Response {
+		return
+	}
+	_, ptrDevice := device()
+	if ptrDevice == "" {
+		return
+	}
+
+	virtualNames.Lock()
+	defer virtualNames.Unlock()
+	for i, q := range msg.Question {
+		if real, ok := virtualNames.m[strings.ToLower(q.Name)]; ok {
+			msg.Question[i].Name = real
+			continue
+		}
+		if q.Qtype != dns.TypePTR {
+			continue
+		}
+		for _, v := range VirtualDevices {
+			if q.Name == IpToPtr(v.Proxy) {
+				msg.Question[i].Name = ptrDevice
+			}
+		}
+	}
+}
+
+// virtualFor devuelve el dispositivo virtual con esa IP de proxy, o nil.
+func virtualFor(ip net.IP) *VirtualDevice {
+	for i := range VirtualDevices {
+		if VirtualDevices[i].Proxy.Equal(ip) {
+			return &VirtualDevices[i]
+		}
+	}
+	return nil
+}
+
+// isInstance indica si name parece una instancia de servicio
+// (instancia._servicio._proto.dominio).
+func isInstance(name string) bool {
+	i := labelEnd(name)
+	return i < len(name) && strings.HasPrefix(name[i:], "._")
+}
+
+// labelEnd devuelve dónde termina la primera etiqueta de name, teniendo en
+// cuenta los puntos escapados.
+func labelEnd(name string) int {
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '\\':
+			i++
+		case '.':
+			return i
+		}
+	}
+	return len(name)
+}
+
+// escapeLabel escapa una etiqueta para usarla en un nombre de miekg/dns.
+func escapeLabel(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '.' || c == ' ' || c == '\\' || c == '"' || c == '(' || c == ')' || c == ';' || c == '@' || c == '$':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
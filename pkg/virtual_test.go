@@ -0,0 +1,103 @@
+package pkg
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testVirtual deja v como único dispositivo virtual mientras dure el test.
+func testVirtual(t *testing.T, v VirtualDevice) {
+	t.Helper()
+	saved := VirtualDevices
+	VirtualDevices = []VirtualDevice{v}
+	t.Cleanup(func() { VirtualDevices = saved })
+}
+
+// deviceAnswer es la respuesta del dispositivo con su instancia TV.
+func deviceAnswer(t *testing.T) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.Response = true
+	msg.Answer = []dns.RR{rr(t, "_googlecast._tcp.local. 120 IN PTR TV._googlecast._tcp.local.")}
+	msg.Extra = []dns.RR{
+		rr(t, "TV._googlecast._tcp.local. 120 IN SRV 0 0 8009 tv.local."),
+		rr(t, `TV._googlecast._tcp.local. 120 IN TXT "id=abc123" "fn=TV"`),
+		rr(t, "tv.local. 120 IN A 192.168.2.172"),
+	}
+	return msg
+}
+
+func TestFanOutRemapsVirtualPorts(t *testing.T) {
+	testAddrs(t)
+	ActiveProfile = Profile{Ports: map[uint16]uint16{8009: 8010}}
+	testVirtual(t, VirtualDevice{Name: "Sala", Proxy: net.ParseIP("10.0.0.6").To4()})
+
+	msg := deviceAnswer(t)
+	fanOut(msg, &net.UDPAddr{IP: net.ParseIP("192.168.2.172"), Port: 5353})
+	rewrite(msg, ToClient)
+
+	ports := map[string]uint16{}
+	for _, r := range msg.Extra {
+		if srv, ok := r.(*dns.SRV); ok {
+			ports[strings.ToLower(srv.Hdr.Name)] = srv.Port
+		}
+	}
+	for _, inst := range []string{"tv._googlecast._tcp.local.", "sala._googlecast._tcp.local."} {
+		if ports[inst] != 8010 {
+			t.Errorf("SRV de %s en el puerto %d, se esperaba 8010", inst, ports[inst])
+		}
+	}
+}
+
+func TestFanOutVirtualIDs(t *testing.T) {
+	testAddrs(t)
+	ActiveProfile = Profile{}
+	saved := VirtualDevices
+	t.Cleanup(func() { VirtualDevices = saved })
+	VirtualDevices = []VirtualDevice{
+		{Name: "Sala", Proxy: net.ParseIP("10.0.0.6").To4()},
+		{Name: "Cocina", Proxy: net.ParseIP("10.0.0.7").To4()},
+		{Name: "Salon", Proxy: net.ParseIP("10.0.0.8").To4(), ID: "fijo"},
+	}
+
+	txtID := func() map[string]string {
+		msg := deviceAnswer(t)
+		fanOut(msg, &net.UDPAddr{IP: net.ParseIP("192.168.2.172"), Port: 5353})
+		ids := map[string]string{}
+		for _, r := range msg.Extra {
+			if txt, ok := r.(*dns.TXT); ok {
+				for _, kv := range txt.Txt {
+					if id, ok := strings.CutPrefix(kv, "id="); ok {
+						ids[strings.ToLower(txt.Hdr.Name)] = id
+					}
+				}
+			}
+		}
+		return ids
+	}
+	ids := txtID()
+
+	if ids["tv._googlecast._tcp.local."] != "abc123" {
+		t.Errorf("id del físico = %q, se esperaba abc123", ids["tv._googlecast._tcp.local."])
+	}
+	if ids["salon._googlecast._tcp.local."] != "fijo" {
+		t.Errorf("el id indicado no se respetó: %v", ids)
+	}
+	if len(ids) != 4 {
+		t.Errorf("ids = %v, se esperaba uno por instancia (4)", ids)
+	}
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if seen[id] {
+			t.Errorf("id repetido %q: %v", id, ids)
+		}
+		seen[id] = true
+	}
+	// Estable: la misma respuesta da los mismos ids.
+	if again := txtID(); !reflect.DeepEqual(again, ids) {
+		t.Errorf("ids distintos entre respuestas: %v y %v", ids, again)
+	}
+}